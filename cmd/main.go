@@ -17,23 +17,40 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/certs"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
 	"github.com/Sindvero/vpa-creation-operator/internal/controller"
 	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+	"github.com/Sindvero/vpa-creation-operator/internal/webhooks"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/config"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -47,6 +64,10 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// errRestartRequired stops the manager when the configuration file changes the
+// watched namespaces or the annotation prefix.
+var errRestartRequired = errors.New("configuration change requires a restart")
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(autoscalingv1.AddToScheme(scheme))
@@ -60,6 +81,41 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var recommendationTimeout time.Duration
+	var evictionFlapThreshold int
+	var evictionFlapWindow time.Duration
+	var evictionFlapCooldown time.Duration
+	var oomBumpFactor float64
+	var oomMaxMemory string
+	var enableWebhooks bool
+	var webhookWarnOnly bool
+	var controllerUsername string
+	var webhookCertDir string
+	var generateWebhookCerts bool
+	var webhookCertSecret string
+	var webhookServiceName string
+	var validatingWebhookConfiguration string
+	var mutatingWebhookConfiguration string
+	var webhookCertValidity time.Duration
+	var webhookCertRotateBefore time.Duration
+	var correctDrift bool
+	var existingVPAPolicy string
+	var vpaNameFallback bool
+	var deletionPolicy string
+	var retainedVPATTL time.Duration
+	var dryRun bool
+	var watchNamespaces string
+	var excludeNamespaces string
+	var maxConcurrentReconciles int
+	var kindConcurrency string
+	var kubeAPIQPS float64
+	var kubeAPIBurst int
+	var backoff controller.Backoff
+	var shardCount int
+	var shardID int
+	var configFile string
+	var annotationPrefix string
+	var previousAnnotationPrefixes string
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -71,6 +127,103 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.DurationVar(&recommendationTimeout, "recommendation-timeout", 30*time.Minute,
+		"How long a managed VPA may be ConfigUnsupported or without recommendation before a Warning event "+
+			"is emitted on its workload. Set to 0 to disable the events.")
+	flag.IntVar(&evictionFlapThreshold, "eviction-flap-threshold", 0,
+		"Number of VPA evictions of a workload within --eviction-flap-window after which its VPA is switched "+
+			"to the Initial update mode. Set to 0 to disable the flapping protection.")
+	flag.DurationVar(&evictionFlapWindow, "eviction-flap-window", time.Hour,
+		"Window over which VPA evictions are counted for the flapping protection.")
+	flag.DurationVar(&evictionFlapCooldown, "eviction-flap-cooldown", 6*time.Hour,
+		"How long a VPA downgraded by the flapping protection stays in the Initial update mode. "+
+			"Set to 0 to only restore it on manual reset.")
+	flag.Float64Var(&oomBumpFactor, "oom-memory-bump-factor", 0,
+		"Factor applied to the memory minAllowed of a managed VPA when a container of its workload is OOM killed. "+
+			"Set to 0 to disable the OOM kill handling.")
+	flag.StringVar(&oomMaxMemory, "oom-memory-max", "8Gi",
+		"Cap the memory minAllowed is never raised above when handling OOM kills.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"If set, the admission webhooks are served. They require a serving certificate in the webhook server cert dir.")
+	flag.BoolVar(&webhookWarnOnly, "webhook-warn-only", false,
+		"If set, workloads with malformed VPA annotations are admitted with a warning instead of being rejected.")
+	flag.StringVar(&controllerUsername, "controller-username", "",
+		"Username the controller authenticates as, allowed to edit managed VPAs. "+
+			"Defaults to the service account of the pod.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs",
+		"Directory the webhook server reads its serving certificate from.")
+	flag.BoolVar(&generateWebhookCerts, "webhook-cert-generate", false,
+		"If set, the controller generates a self-signed CA and serving certificate for the webhooks, stores them "+
+			"in --webhook-cert-secret, injects the CA in the webhook configurations and rotates them before expiry.")
+	flag.StringVar(&webhookCertSecret, "webhook-cert-secret", "webhook-server-cert",
+		"Secret, in the namespace of the controller, holding the generated webhook certificates.")
+	flag.StringVar(&webhookServiceName, "webhook-service-name", "vpa-creation-operator-webhook-service",
+		"Service, in the namespace of the controller, the generated serving certificate is issued for.")
+	flag.StringVar(&validatingWebhookConfiguration, "validating-webhook-configuration",
+		"vpa-creation-operator-validating-webhook-configuration",
+		"ValidatingWebhookConfiguration the generated CA is injected in.")
+	flag.StringVar(&mutatingWebhookConfiguration, "mutating-webhook-configuration",
+		"vpa-creation-operator-mutating-webhook-configuration",
+		"MutatingWebhookConfiguration the generated CA is injected in.")
+	flag.DurationVar(&webhookCertValidity, "webhook-cert-validity", certs.DefaultValidity,
+		"Validity of the generated serving certificate.")
+	flag.DurationVar(&webhookCertRotateBefore, "webhook-cert-rotate-before", certs.DefaultRotateBefore,
+		"How long before expiry the generated serving certificate is rotated.")
+	flag.BoolVar(&correctDrift, "correct-vpa-drift", false,
+		"If set, manual edits of the spec of managed VPAs are reverted, except for the fields listed in the "+
+			"drift-ignore annotation of their workload.")
+	flag.StringVar(&existingVPAPolicy, "existing-vpa-policy", controller.ExistingVPASkip,
+		"What to do when an opted-in workload is already targeted by a VPA the controller did not create: "+
+			"Skip leaves it alone, Adopt makes the workload its owner, Replace deletes it and creates the managed VPA.")
+	flag.BoolVar(&vpaNameFallback, "vpa-name-fallback", false,
+		"If set, the VPA of a workload is named <name>-<kind>-vpa when <name>-vpa is taken by the VPA of another "+
+			"workload. Otherwise the conflict is only reported.")
+	flag.StringVar(&deletionPolicy, "deletion-policy", controller.DeletionPolicyDelete,
+		"Deletion policy of the workloads without the deletion-policy annotation: Delete deletes the VPA with its "+
+			"workload, Retain detaches it so it survives the deletion of the workload.")
+	flag.DurationVar(&retainedVPATTL, "retained-vpa-ttl", 7*24*time.Hour,
+		"How long a VPA retained after the deletion of its workload is kept before being garbage collected. "+
+			"Set to 0 to keep it forever.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"If set, the controllers only log, count and report as events the creates, updates and deletes they "+
+			"would make, without sending them to the API server. The defaulting webhook is not served. The "+
+			"validating webhooks still reject invalid requests, and --webhook-cert-generate still writes the "+
+			"certificate Secret and the CA of the webhook configurations, as the webhook server needs them.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated list of the namespaces to watch. Empty watches every namespace. "+
+			"With a list, the controller only needs Roles in those namespaces.")
+	flag.StringVar(&excludeNamespaces, "exclude-namespaces", strings.Join(controller.DefaultExcludedNamespaces, ","),
+		"Comma-separated list of namespaces never to watch, even if listed in --watch-namespaces.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"Number of reconciles each controller runs concurrently.")
+	flag.StringVar(&kindConcurrency, "max-concurrent-reconciles-per-kind", "",
+		"Comma-separated list of <kind>=<workers> pairs overriding --max-concurrent-reconciles for the "+
+			"controllers of the workload kinds, e.g. Deployment=8,StatefulSet=2.")
+	flag.Float64Var(&kubeAPIQPS, "kube-api-qps", 20,
+		"Maximum sustained queries per second of the controller to the API server.")
+	flag.IntVar(&kubeAPIBurst, "kube-api-burst", 30,
+		"Maximum burst of queries of the controller to the API server.")
+	flag.DurationVar(&backoff.Base, "reconcile-backoff-base", 5*time.Millisecond,
+		"Delay before retrying a failed reconcile, doubled on each consecutive failure of the same object.")
+	flag.DurationVar(&backoff.Max, "reconcile-backoff-max", 1000*time.Second,
+		"Longest delay before retrying a failed reconcile.")
+	flag.IntVar(&shardCount, "shard-count", 1,
+		"Number of static shards the namespaces are split into by hashing their name. Each shard is handled by "+
+			"the replicas given its --shard-id, with leader election among them. A shard has no failover to the "+
+			"other shards: its namespaces are not handled while all its replicas are down. "+
+			"Must be the same on every replica. Set to 1 to disable sharding.")
+	flag.IntVar(&shardID, "shard-id", -1,
+		"Fixed shard handled by this replica, from 0 to --shard-count minus 1, set on each Deployment when "+
+			"running one Deployment of replicas per shard. Defaults to the ordinal suffix of the hostname, so each "+
+			"pod of a StatefulSet with --shard-count replicas handles its own shard, without standby replica.")
+	flag.StringVar(&annotationPrefix, "annotation-prefix", annotations.Prefix,
+		"Prefix of the annotations, labels and finalizer of the controller, ending with a slash. "+
+			"Instances of the controller with different prefixes manage their own workloads and VPAs only.")
+	flag.StringVar(&previousAnnotationPrefixes, "previous-annotation-prefixes", "",
+		"Comma-separated list of the prefixes the controller used before --annotation-prefix. Their finalizers "+
+			"are removed from the workloads, and the VPAs they labelled are managed under the current prefix.")
+	flag.StringVar(&configFile, "config", "",
+		"Configuration file of the controller, reloaded on change. Its fields override the matching flags.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -78,6 +231,7 @@ func main() {
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	ctx, stop := context.WithCancelCause(ctrl.SetupSignalHandler())
 
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
@@ -95,6 +249,7 @@ func main() {
 	}
 
 	webhookServer := webhook.NewServer(webhook.Options{
+		CertDir: webhookCertDir,
 		TLSOpts: tlsOpts,
 	})
 
@@ -121,15 +276,139 @@ func main() {
 		// https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.19.0/pkg/metrics/filters#WithAuthenticationAndAuthorization
 		metricsServerOptions.FilterProvider = filters.WithAuthenticationAndAuthorization
 	}
+	maxMemory, err := resource.ParseQuantity(oomMaxMemory)
+	if err != nil {
+		setupLog.Error(err, "invalid --oom-memory-max")
+		os.Exit(1)
+	}
+	if oomBumpFactor != 0 && oomBumpFactor <= 1 {
+		setupLog.Error(nil, "--oom-memory-bump-factor must be greater than 1", "factor", oomBumpFactor)
+		os.Exit(1)
+	}
+
+	if !slices.Contains(controller.ExistingVPAPolicies, existingVPAPolicy) {
+		setupLog.Error(nil, "--existing-vpa-policy must be one of "+strings.Join(controller.ExistingVPAPolicies, ", "),
+			"policy", existingVPAPolicy)
+		os.Exit(1)
+	}
+
+	if deletionPolicy != controller.DeletionPolicyDelete && deletionPolicy != controller.DeletionPolicyRetain {
+		setupLog.Error(nil, "--deletion-policy must be Delete or Retain", "policy", deletionPolicy)
+		os.Exit(1)
+	}
+
+	if err := annotations.ValidatePrefix(field.NewPath("annotation-prefix"), annotationPrefix); err != nil {
+		setupLog.Error(err, "invalid --annotation-prefix")
+		os.Exit(1)
+	}
+	baseConfig := config.Default()
+	baseConfig.AnnotationPrefix = annotationPrefix
+	baseConfig.PreviousAnnotationPrefixes = annotations.List(previousAnnotationPrefixes)
+	for i, prefix := range baseConfig.PreviousAnnotationPrefixes {
+		if err := annotations.ValidatePrefix(field.NewPath("previous-annotation-prefixes").Index(i), prefix); err != nil {
+			setupLog.Error(err, "invalid --previous-annotation-prefixes")
+			os.Exit(1)
+		}
+	}
+	baseConfig.Namespaces = config.Namespaces{
+		Watch:   annotations.List(watchNamespaces),
+		Exclude: annotations.List(excludeNamespaces),
+	}
+	cfg := baseConfig
+	if configFile != "" {
+		cfg, err = config.Load(configFile, baseConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load the configuration file", "path", configFile)
+			os.Exit(1)
+		}
+	}
+	configStore := config.NewStore(cfg)
+
+	namespaces := controller.NamespaceFilter{
+		Watch:   cfg.Namespaces.Watch,
+		Exclude: cfg.Namespaces.Exclude,
+	}
+	if len(namespaces.Watch) > 0 && len(namespaces.CacheNamespaces(nil)) == 0 {
+		setupLog.Error(nil, "every watched namespace is excluded")
+		os.Exit(1)
+	}
+
+	keys := cfg.Keys()
+	leaderElectionID := "83f350a1.vpacreation.com"
+	if keys.Instance != "" {
+		// Instances with different prefixes run side by side.
+		leaderElectionID = keys.Instance + "-" + leaderElectionID
+	}
+	if shardCount > 1 {
+		if shardID < 0 {
+			hostname, err := os.Hostname()
+			if err == nil {
+				shardID, err = controller.ShardFromHostname(hostname)
+			}
+			if err != nil {
+				setupLog.Error(err, "unable to determine the shard, set --shard-id")
+				os.Exit(1)
+			}
+		}
+		if shardID >= shardCount {
+			setupLog.Error(nil, "--shard-id must be lower than --shard-count", "shard", shardID, "shards", shardCount)
+			os.Exit(1)
+		}
+		setupLog.Info("Handling a shard of the namespaces", "shard", shardID, "shards", shardCount)
+		namespaces.Shard = controller.Shard{ID: shardID, Count: shardCount}
+		// Only one replica of each shard does the work, the others stand by.
+		enableLeaderElection = true
+		leaderElectionID = fmt.Sprintf("%s-shard-%d", leaderElectionID, shardID)
+	}
+
+	groupKindConcurrency, err := controller.ParseKindConcurrency(kindConcurrency)
+	if err != nil {
+		setupLog.Error(err, "invalid --max-concurrent-reconciles-per-kind")
+		os.Exit(1)
+	}
+	if maxConcurrentReconciles < 1 {
+		setupLog.Error(nil, "--max-concurrent-reconciles must be at least 1", "workers", maxConcurrentReconciles)
+		os.Exit(1)
+	}
+	if backoff.Base <= 0 || backoff.Max < backoff.Base {
+		setupLog.Error(nil, "--reconcile-backoff-base must be positive and at most --reconcile-backoff-max",
+			"base", backoff.Base, "max", backoff.Max)
+		os.Exit(1)
+	}
+
 	collectors := metrics.SetupMetrics()
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	evictionEvents := fields.OneTermEqualSelector("reason", controller.EvictionReason)
+	restConfig := ctrl.GetConfigOrDie()
+	restConfig.QPS = float32(kubeAPIQPS)
+	restConfig.Burst = kubeAPIBurst
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "83f350a1.vpacreation.com",
+		LeaderElectionID:       leaderElectionID,
+		Controller: ctrlconfig.Controller{
+			MaxConcurrentReconciles: maxConcurrentReconciles,
+			GroupKindConcurrency:    groupKindConcurrency,
+		},
+		Cache: cache.Options{
+			DefaultNamespaces: namespaces.CacheNamespaces(nil),
+			// The controller never reads managed fields, which make up much of the cached objects.
+			DefaultTransform: cache.TransformStripManagedFields(),
+			ByObject: map[client.Object]cache.ByObject{
+				// Pods are only cached for the OOM kills of their containers.
+				&corev1.Pod{}: {
+					Transform: controller.TransformPod,
+				},
+				// Only the eviction events of the VPA updater are of interest to the controller.
+				&corev1.Event{}: {
+					Field:      evictionEvents,
+					Namespaces: namespaces.CacheNamespaces(evictionEvents),
+				},
+			},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -147,6 +426,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The controllers need the VPA CRD, checked once rather than on every reconcile.
+	vpaKind := autoscalingv1.SchemeGroupVersion.WithKind("VerticalPodAutoscaler")
+	if _, err := mgr.GetRESTMapper().RESTMapping(vpaKind.GroupKind(), vpaKind.Version); err != nil {
+		setupLog.Error(err, "the VerticalPodAutoscaler CRD is not installed")
+		os.Exit(1)
+	}
+
+	if err := controller.SetupIndexes(ctx, mgr.GetFieldIndexer()); err != nil {
+		setupLog.Error(err, "unable to set up field indexes")
+		os.Exit(1)
+	}
+
+	recorder := mgr.GetEventRecorderFor("vpauto-creation-controller")
+	reconcilerClient := mgr.GetClient()
+	if dryRun {
+		setupLog.Info("Running in dry-run mode, no change will be made to the cluster")
+		reconcilerClient = controller.NewDryRunClient(reconcilerClient, collectors, recorder)
+	}
+
 	types := []client.Object{
 		&appsv1.Deployment{},
 		&appsv1.DaemonSet{},
@@ -155,16 +453,136 @@ func main() {
 
 	for _, obj := range types {
 		if err := (&controller.VPAControllerReconciler{
-			Client:  mgr.GetClient(),
-			Scheme:  mgr.GetScheme(),
-			Metrics: collectors,
+			Client:            reconcilerClient,
+			Scheme:            mgr.GetScheme(),
+			Metrics:           collectors,
+			Recorder:          recorder,
+			CorrectDrift:      correctDrift,
+			ExistingVPAPolicy: existingVPAPolicy,
+			NameFallback:      vpaNameFallback,
+			DeletionPolicy:    deletionPolicy,
+			RetainTTL:         retainedVPATTL,
+			Namespaces:        namespaces,
+			Backoff:           backoff,
+			Config:            configStore,
 		}).SetupWithManagerFor(obj, mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", obj.GetObjectKind().GroupVersionKind().Kind)
 			os.Exit(1)
 		}
 	}
+	if err := mgr.Add(&controller.GarbageCollector{
+		Client:     reconcilerClient,
+		Metrics:    collectors,
+		RetainTTL:  retainedVPATTL,
+		Namespaces: namespaces,
+		Config:     configStore,
+	}); err != nil {
+		setupLog.Error(err, "unable to add the VPA garbage collector")
+		os.Exit(1)
+	}
+	if err := (&controller.VPAStatusReconciler{
+		Client:                reconcilerClient,
+		Scheme:                mgr.GetScheme(),
+		Metrics:               collectors,
+		Recorder:              recorder,
+		RecommendationTimeout: recommendationTimeout,
+		FlapCooldown:          evictionFlapCooldown,
+		Namespaces:            namespaces,
+		Backoff:               backoff,
+		Config:                configStore,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VPAStatus")
+		os.Exit(1)
+	}
+	if err := (&controller.EvictionReconciler{
+		Client:        reconcilerClient,
+		APIReader:     mgr.GetAPIReader(),
+		Metrics:       collectors,
+		Recorder:      recorder,
+		FlapThreshold: evictionFlapThreshold,
+		FlapWindow:    evictionFlapWindow,
+		Namespaces:    namespaces,
+		Backoff:       backoff,
+		Config:        configStore,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Eviction")
+		os.Exit(1)
+	}
+	if oomBumpFactor > 0 {
+		if err := (&controller.OOMKillReconciler{
+			Client:     reconcilerClient,
+			APIReader:  mgr.GetAPIReader(),
+			Metrics:    collectors,
+			Recorder:   recorder,
+			BumpFactor: oomBumpFactor,
+			MaxMemory:  maxMemory,
+			Namespaces: namespaces,
+			Backoff:    backoff,
+			Config:     configStore,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "OOMKill")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	if enableWebhooks {
+		mgr.GetWebhookServer().Register(webhooks.WorkloadValidatorPath, &webhook.Admission{
+			Handler: &webhooks.WorkloadValidator{WarnOnly: webhookWarnOnly, Keys: keys},
+		})
+		if dryRun {
+			setupLog.Info("Not serving the defaulting webhook in dry-run mode")
+		} else {
+			mgr.GetWebhookServer().Register(webhooks.WorkloadDefaulterPath, &webhook.Admission{
+				Handler: &webhooks.WorkloadDefaulter{Client: mgr.GetClient(), Keys: keys},
+			})
+		}
+
+		if controllerUsername == "" {
+			controllerUsername, err = webhooks.ServiceAccountUsername("/var/run/secrets/kubernetes.io/serviceaccount/token")
+			if err != nil {
+				setupLog.Error(err, "unable to determine the controller username, set --controller-username")
+				os.Exit(1)
+			}
+		}
+		mgr.GetWebhookServer().Register(webhooks.VPAGuardPath, &webhook.Admission{
+			Handler: &webhooks.VPAGuard{ControllerUsername: controllerUsername, Keys: keys},
+		})
+
+		if generateWebhookCerts {
+			namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+			if err != nil {
+				setupLog.Error(err, "unable to determine the controller namespace")
+				os.Exit(1)
+			}
+			// The manager cache is not started yet, and only one Secret is needed.
+			directClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+			if err != nil {
+				setupLog.Error(err, "unable to create client")
+				os.Exit(1)
+			}
+			rotator := &certs.Rotator{
+				Client:             directClient,
+				SecretKey:          client.ObjectKey{Namespace: string(namespace), Name: webhookCertSecret},
+				ServiceName:        webhookServiceName,
+				CertDir:            webhookCertDir,
+				ValidatingWebhooks: []string{validatingWebhookConfiguration},
+				MutatingWebhooks:   []string{mutatingWebhookConfiguration},
+				Validity:           webhookCertValidity,
+				RotateBefore:       webhookCertRotateBefore,
+				CheckInterval:      certs.DefaultCheckInterval,
+			}
+			if err := rotator.EnsureCerts(ctx); err != nil {
+				setupLog.Error(err, "unable to provision webhook certificates")
+				os.Exit(1)
+			}
+			if err := mgr.Add(rotator); err != nil {
+				setupLog.Error(err, "unable to set up webhook certificate rotation")
+				os.Exit(1)
+			}
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -174,9 +592,39 @@ func main() {
 		os.Exit(1)
 	}
 
+	if configFile != "" {
+		if err := mgr.Add(&config.Watcher{Path: configFile, Base: baseConfig, Store: configStore}); err != nil {
+			setupLog.Error(err, "unable to set up configuration reload")
+			os.Exit(1)
+		}
+		// The cache is restricted to the watched namespaces when the manager is
+		// created, and the annotation prefix identifies the instance for the leader
+		// election and the webhooks, so changing either takes a restart.
+		changed := configStore.Subscribe()
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+				}
+				next := configStore.Get()
+				if !reflect.DeepEqual(next.Namespaces, cfg.Namespaces) || next.AnnotationPrefix != cfg.AnnotationPrefix {
+					stop(errRestartRequired)
+					return
+				}
+			}
+		}()
+	}
+
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	if errors.Is(context.Cause(ctx), errRestartRequired) {
+		// Exit so that the pod is restarted with the new configuration.
+		setupLog.Info("Restarting to apply the namespaces or annotation prefix of the new configuration")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,244 @@
+// Package annotations defines the annotations workloads use to opt in and
+// configure their VPA, and how they are validated.
+package annotations
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Prefix is the prefix of every annotation understood by the controller.
+const Prefix = "k8s.autoscaling.vpacreation/"
+
+// ManagedBy is the label marking the VPAs created by the controller with ManagedByValue.
+const (
+	ManagedBy      = "app.kubernetes.io/managed-by"
+	ManagedByValue = "vpauto-creation-controller"
+)
+
+// Keys are the annotations, labels and finalizer of the controller under a given
+// prefix, for controllers configured with another prefix than Prefix. Instances
+// of the controller with different prefixes manage their own VPAs only.
+type Keys struct {
+	Prefix string
+
+	// VPAEnabled opts a workload in when set to "true".
+	VPAEnabled string
+	// UpdateMode selects the update mode of the generated VPA.
+	UpdateMode string
+	// OptOut set to "true" prevents the namespace defaults from being applied.
+	OptOut string
+	// DriftIgnore is a comma-separated list of VPA spec fields that may be edited by
+	// hand without being reverted by the drift correction.
+	DriftIgnore string
+	// DeletionPolicy selects whether the VPA is deleted with the workload or retained.
+	DeletionPolicy string
+	// InheritFrom names a workload of the same namespace whose VPA recommendation
+	// seeds the minAllowed of the VPA created for this workload.
+	InheritFrom string
+	// Config holds a WorkloadConfig document configuring the whole VPA.
+	Config string
+
+	// DefaultOptIn is the namespace label opting in every new workload of the
+	// namespace when set to "true".
+	DefaultOptIn string
+	// DefaultUpdateMode is the namespace label giving the update mode of the
+	// workloads opted in by default.
+	DefaultUpdateMode string
+
+	// AllowManualEdit set to "true" on a managed VPA lets it be edited by hand.
+	AllowManualEdit string
+
+	// Annotations recorded by the controller on the managed VPAs.
+	CreatedAt             string
+	FirstRecommendationAt string
+	RetainedAt            string
+	InheritedFrom         string
+	DowngradedFrom        string
+	DowngradedAt          string
+	DowngradeReason       string
+	ResetDowngrade        string
+	LastOOMBumpAt         string
+	ExcludedContainers    string
+	// Adopted marks a VPA adopted by its workload under the Adopt existing VPA
+	// policy, so it is not taken for a VPA created by an earlier version.
+	Adopted string
+	// InvalidConfig records a hash of the invalid config annotation of the
+	// workload last warned about, so each invalid value is only warned about once.
+	InvalidConfig string
+	// TimeoutWarning records the reason and start of the last recommendation
+	// timeout warned about, so each timeout is only warned about once.
+	TimeoutWarning string
+
+	// RetainFinalizer holds the deletion of a workload with the Retain deletion
+	// policy until its VPA is detached.
+	RetainFinalizer string
+	// Instance identifies the controller instance using the prefix. It is empty
+	// for Prefix, and a hash of the prefix otherwise.
+	Instance string
+	// ManagedByValue is the value of the ManagedBy label on the VPAs created by
+	// the instance, and the field manager they are applied with.
+	ManagedByValue string
+}
+
+// DefaultKeys are the annotations under Prefix.
+var DefaultKeys = KeysFor(Prefix)
+
+// KeysFor returns the annotations under the prefix, which ends with a slash.
+func KeysFor(prefix string) Keys {
+	k := Keys{
+		Prefix:            prefix,
+		VPAEnabled:        prefix + "vpa-enabled",
+		UpdateMode:        prefix + "update-mode",
+		OptOut:            prefix + "opt-out",
+		DriftIgnore:       prefix + "drift-ignore",
+		DeletionPolicy:    prefix + "deletion-policy",
+		InheritFrom:       prefix + "inherit-from",
+		Config:            prefix + "config",
+		DefaultOptIn:      prefix + "default-opt-in",
+		DefaultUpdateMode: prefix + "default-update-mode",
+		AllowManualEdit:   prefix + "allow-manual-edit",
+
+		CreatedAt:             prefix + "created-at",
+		FirstRecommendationAt: prefix + "first-recommendation-at",
+		RetainedAt:            prefix + "retained-at",
+		InheritedFrom:         prefix + "inherited-from",
+		DowngradedFrom:        prefix + "downgraded-from",
+		DowngradedAt:          prefix + "downgraded-at",
+		DowngradeReason:       prefix + "downgrade-reason",
+		ResetDowngrade:        prefix + "reset-downgrade",
+		LastOOMBumpAt:         prefix + "last-oom-bump-at",
+		ExcludedContainers:    prefix + "excluded-containers",
+		Adopted:               prefix + "adopted",
+		InvalidConfig:         prefix + "invalid-config",
+		TimeoutWarning:        prefix + "timeout-warning",
+
+		RetainFinalizer: prefix + "retain-vpa",
+		ManagedByValue:  ManagedByValue,
+	}
+	if prefix != Prefix {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(prefix))
+		k.Instance = fmt.Sprintf("%08x", h.Sum32())
+		k.ManagedByValue = ManagedByValue + "-" + k.Instance
+	}
+	return k
+}
+
+// ValidatePrefix checks that the prefix is a DNS subdomain followed by a slash.
+func ValidatePrefix(path *field.Path, prefix string) *field.Error {
+	domain, ok := strings.CutSuffix(prefix, "/")
+	if !ok {
+		return field.Invalid(path, prefix, "must end with a slash")
+	}
+	if msgs := validation.IsDNS1123Subdomain(domain); len(msgs) > 0 {
+		return field.Invalid(path, prefix, strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// UpdateModes are the values accepted by the UpdateMode annotation.
+var UpdateModes = []string{"Off", "Initial", "Recreate", "Auto"}
+
+// DeletionPolicies are the values accepted by the DeletionPolicy annotation.
+var DeletionPolicies = []string{"Delete", "Retain"}
+
+// DriftFields are the VPA spec fields accepted by the DriftIgnore annotation.
+var DriftFields = []string{"updatePolicy", "resourcePolicy", "recommenders"}
+
+// List splits a comma-separated annotation value, dropping empty items.
+func List(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validators checks the value of each known workload annotation, by name under the prefix.
+var validators = map[string]func(path *field.Path, value string) field.ErrorList{
+	"vpa-enabled":     oneOf("true", "false"),
+	"update-mode":     oneOf(UpdateModes...),
+	"opt-out":         oneOf("true", "false"),
+	"drift-ignore":    listOf(DriftFields...),
+	"deletion-policy": oneOf(DeletionPolicies...),
+	"inherit-from":    objectName,
+	"config":          config,
+}
+
+// Validate checks the workload annotations under the prefix of the keys and
+// returns an error for every unknown or malformed one.
+func (k Keys) Validate(annotations map[string]string) field.ErrorList {
+	var errs field.ErrorList
+	path := field.NewPath("metadata", "annotations")
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		if strings.HasPrefix(key, k.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		validate, ok := validators[strings.TrimPrefix(key, k.Prefix)]
+		if !ok {
+			errs = append(errs, field.Invalid(path.Key(key), annotations[key],
+				fmt.Sprintf("unknown annotation, supported annotations are: %s", strings.Join(k.known(), ", "))))
+			continue
+		}
+		errs = append(errs, validate(path.Key(key), annotations[key])...)
+	}
+	return errs
+}
+
+func oneOf(values ...string) func(path *field.Path, value string) field.ErrorList {
+	return func(path *field.Path, value string) field.ErrorList {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return field.ErrorList{field.NotSupported(path, value, values)}
+	}
+}
+
+func listOf(values ...string) func(path *field.Path, value string) field.ErrorList {
+	item := oneOf(values...)
+	return func(path *field.Path, value string) field.ErrorList {
+		for _, v := range List(value) {
+			if errs := item(path, v); len(errs) > 0 {
+				return errs
+			}
+		}
+		return nil
+	}
+}
+
+func objectName(path *field.Path, value string) field.ErrorList {
+	if msgs := validation.IsDNS1123Subdomain(value); len(msgs) > 0 {
+		return field.ErrorList{field.Invalid(path, value, strings.Join(msgs, "; "))}
+	}
+	return nil
+}
+
+func config(path *field.Path, value string) field.ErrorList {
+	_, errs := ParseConfig(path, value)
+	return errs
+}
+
+func (k Keys) known() []string {
+	keys := make([]string, 0, len(validators))
+	for name := range validators {
+		keys = append(keys, k.Prefix+name)
+	}
+	sort.Strings(keys)
+	return keys
+}
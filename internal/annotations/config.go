@@ -0,0 +1,259 @@
+package annotations
+
+import (
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/json"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigAPIVersion and ConfigKind identify the version of the document of the
+// Config annotation.
+const (
+	ConfigAPIVersion = "vpacreation.com/v1alpha1"
+	ConfigKind       = "VPAConfig"
+)
+
+// WorkloadConfig is the JSON or YAML document of the Config annotation,
+// configuring the whole VPA of a workload in a single annotation. Its fields
+// take precedence over the separate annotations.
+type WorkloadConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// UpdateMode is the update mode of the VPA, one of UpdateModes.
+	UpdateMode string `json:"updateMode,omitempty"`
+	// Profile selects the recommenders of the VPA. The profiles of the controller
+	// configuration map to their recommenders, any other profile to the
+	// recommender of the same name.
+	Profile string `json:"profile,omitempty"`
+	// Containers are the resource policies of the containers of the workload.
+	Containers []ContainerConfig `json:"containers,omitempty"`
+}
+
+// ContainerConfig is the resource policy of a container, or of every container
+// without policy of its own when its name is "*".
+type ContainerConfig struct {
+	Name string `json:"name"`
+	// Mode turns the recommendations for the container on or off, one of ContainerModes.
+	Mode string `json:"mode,omitempty"`
+	// MinAllowed and MaxAllowed bound the recommendations for the container.
+	MinAllowed corev1.ResourceList `json:"minAllowed,omitempty"`
+	MaxAllowed corev1.ResourceList `json:"maxAllowed,omitempty"`
+	// ControlledResources are the resources recommended for, cpu and memory by default.
+	ControlledResources []corev1.ResourceName `json:"controlledResources,omitempty"`
+	// ControlledValues is which of the requests and limits are updated, one of ControlledValues.
+	ControlledValues string `json:"controlledValues,omitempty"`
+}
+
+// ContainerModes are the values accepted by the mode of a container.
+var ContainerModes = []string{"Auto", "Off"}
+
+// ControlledValues are the values accepted by the controlledValues of a container.
+var ControlledValues = []string{"RequestsAndLimits", "RequestsOnly"}
+
+// Resources are the resources accepted in the policies of a container.
+var Resources = []string{string(corev1.ResourceCPU), string(corev1.ResourceMemory)}
+
+// ParseConfig decodes and validates the document of the Config annotation found
+// at path. Unknown fields are rejected, and every error points to its field
+// under path.
+func ParseConfig(path *field.Path, value string) (*WorkloadConfig, field.ErrorList) {
+	data, err := yaml.YAMLToJSON([]byte(value))
+	if err != nil {
+		return nil, field.ErrorList{field.Invalid(path, value, err.Error())}
+	}
+	var c WorkloadConfig
+	strictErrs, err := json.UnmarshalStrict(data, &c)
+	if err != nil {
+		// The decoder stops at the first error without telling where it is.
+		if errs := decodeErrors(path, data, reflect.TypeOf(c)); len(errs) > 0 {
+			return nil, errs
+		}
+		return nil, field.ErrorList{field.Invalid(path, value, err.Error())}
+	}
+	if len(strictErrs) > 0 {
+		var errs field.ErrorList
+		for _, err := range strictErrs {
+			// Unknown and duplicate fields are reported at their path in the document.
+			var fieldErr json.FieldError
+			if errors.As(err, &fieldErr) {
+				reason, _, _ := strings.Cut(err.Error(), " \"")
+				errs = append(errs, field.Forbidden(path.Child(fieldErr.FieldPath()), reason))
+				continue
+			}
+			errs = append(errs, field.Invalid(path, value, err.Error()))
+		}
+		return nil, errs
+	}
+	if errs := c.Validate(path); len(errs) > 0 {
+		return nil, errs
+	}
+	return &c, nil
+}
+
+// decodeErrors decodes the JSON object into a value of type t field by field,
+// recursing into the lists of structs and the maps such as resource lists, and
+// returns the errors at the field they occur, such as an invalid quantity or a
+// value of the wrong type.
+func decodeErrors(path *field.Path, data []byte, t reflect.Type) field.ErrorList {
+	var fields map[string]stdjson.RawMessage
+	if err := stdjson.Unmarshal(data, &fields); err != nil {
+		return field.ErrorList{field.Invalid(path, jsonValue(data), err.Error())}
+	}
+	types := jsonFields(t)
+
+	var errs field.ErrorList
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		p, raw := path.Child(name), fields[name]
+		ft, ok := types[name]
+		switch {
+		case !ok:
+			errs = append(errs, field.Forbidden(p, "unknown field"))
+		case ft.Kind() == reflect.Map:
+			var values map[string]stdjson.RawMessage
+			if err := stdjson.Unmarshal(raw, &values); err != nil {
+				errs = append(errs, field.Invalid(p, jsonValue(raw), err.Error()))
+				continue
+			}
+			for _, key := range slices.Sorted(maps.Keys(values)) {
+				errs = append(errs, decodeValue(p.Key(key), values[key], ft.Elem())...)
+			}
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+			var items []stdjson.RawMessage
+			if err := stdjson.Unmarshal(raw, &items); err != nil {
+				errs = append(errs, field.Invalid(p, jsonValue(raw), err.Error()))
+				continue
+			}
+			for i, item := range items {
+				errs = append(errs, decodeErrors(p.Index(i), item, ft.Elem())...)
+			}
+		default:
+			errs = append(errs, decodeValue(p, raw, ft)...)
+		}
+	}
+	return errs
+}
+
+// decodeValue decodes the JSON value into a value of type t.
+func decodeValue(path *field.Path, data []byte, t reflect.Type) field.ErrorList {
+	if err := json.UnmarshalCaseSensitivePreserveInts(data, reflect.New(t).Interface()); err != nil {
+		return field.ErrorList{field.Invalid(path, jsonValue(data), err.Error())}
+	}
+	return nil
+}
+
+// jsonFields returns the types of the fields of a struct by their JSON name.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = t.Field(i).Type
+	}
+	return fields
+}
+
+// jsonValue is a JSON value, reported as is in the errors.
+type jsonValue []byte
+
+func (v jsonValue) String() string {
+	return string(v)
+}
+
+// Validate checks the document, reporting errors under path.
+func (c *WorkloadConfig) Validate(path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if c.APIVersion != ConfigAPIVersion {
+		errs = append(errs, field.NotSupported(path.Child("apiVersion"), c.APIVersion, []string{ConfigAPIVersion}))
+	}
+	if c.Kind != ConfigKind {
+		errs = append(errs, field.NotSupported(path.Child("kind"), c.Kind, []string{ConfigKind}))
+	}
+	if c.UpdateMode != "" && !slices.Contains(UpdateModes, c.UpdateMode) {
+		errs = append(errs, field.NotSupported(path.Child("updateMode"), c.UpdateMode, UpdateModes))
+	}
+	if c.Profile != "" {
+		if msgs := validation.IsDNS1123Label(c.Profile); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path.Child("profile"), c.Profile, strings.Join(msgs, "; ")))
+		}
+	}
+
+	names := map[string]bool{}
+	for i, container := range c.Containers {
+		p := path.Child("containers").Index(i)
+		switch {
+		case container.Name == "":
+			errs = append(errs, field.Required(p.Child("name"), ""))
+		case names[container.Name]:
+			errs = append(errs, field.Duplicate(p.Child("name"), container.Name))
+		case container.Name != "*":
+			if msgs := validation.IsDNS1123Label(container.Name); len(msgs) > 0 {
+				errs = append(errs, field.Invalid(p.Child("name"), container.Name, strings.Join(msgs, "; ")))
+			}
+		}
+		names[container.Name] = true
+		errs = append(errs, container.validate(p)...)
+	}
+	return errs
+}
+
+func (c *ContainerConfig) validate(path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if c.Mode != "" && !slices.Contains(ContainerModes, c.Mode) {
+		errs = append(errs, field.NotSupported(path.Child("mode"), c.Mode, ContainerModes))
+	}
+	errs = append(errs, validateResources(path.Child("minAllowed"), c.MinAllowed)...)
+	errs = append(errs, validateResources(path.Child("maxAllowed"), c.MaxAllowed)...)
+	for _, name := range Resources {
+		lower, hasLower := c.MinAllowed[corev1.ResourceName(name)]
+		upper, hasUpper := c.MaxAllowed[corev1.ResourceName(name)]
+		if hasLower && hasUpper && lower.Cmp(upper) > 0 {
+			errs = append(errs, field.Invalid(path.Child("maxAllowed").Key(name), upper.String(),
+				fmt.Sprintf("must not be less than minAllowed %s", lower.String())))
+		}
+	}
+	seen := map[corev1.ResourceName]bool{}
+	for i, name := range c.ControlledResources {
+		switch {
+		case !slices.Contains(Resources, string(name)):
+			errs = append(errs, field.NotSupported(path.Child("controlledResources").Index(i), string(name), Resources))
+		case seen[name]:
+			errs = append(errs, field.Duplicate(path.Child("controlledResources").Index(i), string(name)))
+		}
+		seen[name] = true
+	}
+	if c.ControlledValues != "" && !slices.Contains(ControlledValues, c.ControlledValues) {
+		errs = append(errs, field.NotSupported(path.Child("controlledValues"), c.ControlledValues, ControlledValues))
+	}
+	return errs
+}
+
+func validateResources(path *field.Path, resources corev1.ResourceList) field.ErrorList {
+	var errs field.ErrorList
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, string(name))
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		quantity := resources[corev1.ResourceName(name)]
+		switch {
+		case !slices.Contains(Resources, name):
+			errs = append(errs, field.NotSupported(path.Key(name), name, Resources))
+		case quantity.Sign() < 0:
+			errs = append(errs, field.Invalid(path.Key(name), quantity.String(), "must not be negative"))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,324 @@
+// Package certs provisions and rotates the serving certificate of the webhook
+// server without relying on an external certificate manager.
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// +kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=get;create;update
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations;mutatingwebhookconfigurations,verbs=get;update
+
+// Keys of the certificate Secret.
+const (
+	CACertKey = "ca.crt"
+	CAKeyKey  = "ca.key"
+	CertKey   = corev1.TLSCertKey
+	KeyKey    = corev1.TLSPrivateKeyKey
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+	// DefaultValidity is the validity of the serving certificate.
+	DefaultValidity = 365 * 24 * time.Hour
+	// DefaultRotateBefore is how long before expiry the serving certificate is rotated.
+	DefaultRotateBefore = 30 * 24 * time.Hour
+	// DefaultCheckInterval is how often the certificate is checked for rotation.
+	DefaultCheckInterval = time.Hour
+)
+
+// Rotator keeps a self-signed CA and a serving certificate for the webhook
+// Service in a Secret, writes the serving certificate to the webhook server cert
+// dir, and injects the CA in the webhook configurations.
+//
+// Every replica runs a Rotator so all of them serve the current certificate; they
+// coordinate through the resource version of the Secret.
+type Rotator struct {
+	// Client must not be backed by the manager cache, the certificate is needed
+	// before the manager starts.
+	Client    client.Client
+	SecretKey types.NamespacedName
+	// ServiceName is the name of the webhook Service, in the namespace of the Secret.
+	ServiceName string
+	CertDir     string
+	// ValidatingWebhooks and MutatingWebhooks are the names of the webhook
+	// configurations the CA is injected in.
+	ValidatingWebhooks []string
+	MutatingWebhooks   []string
+
+	Validity      time.Duration
+	RotateBefore  time.Duration
+	CheckInterval time.Duration
+}
+
+// EnsureCerts creates or rotates the certificates if needed, then writes them to
+// the cert dir and injects the CA in the webhook configurations.
+func (r *Rotator) EnsureCerts(ctx context.Context) error {
+	secret, err := r.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.writeCertDir(secret); err != nil {
+		return err
+	}
+	return r.injectCABundle(ctx, secret.Data[CACertKey])
+}
+
+// Start checks the certificates every CheckInterval until the context is done.
+func (r *Rotator) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+	ticker := time.NewTicker(r.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.EnsureCerts(ctx); err != nil {
+				logger.Error(err, "Failed to rotate webhook certificates")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection is false, every replica must keep its serving certificate up to date.
+func (r *Rotator) NeedLeaderElection() bool {
+	return false
+}
+
+func (r *Rotator) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+
+	var secret corev1.Secret
+	err := r.Client.Get(ctx, r.SecretKey, &secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+
+	if exists && !r.needsRotation(secret.Data, time.Now()) {
+		return &secret, nil
+	}
+
+	data, err := r.generate(secret.Data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		secret = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: r.SecretKey.Name, Namespace: r.SecretKey.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}
+		logger.Info("Generating webhook certificates", "secret", r.SecretKey)
+		err = r.Client.Create(ctx, &secret)
+	} else {
+		secret.Data = data
+		logger.Info("Rotating webhook certificates", "secret", r.SecretKey)
+		err = r.Client.Update(ctx, &secret)
+	}
+	if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+		// Another replica rotated the certificates first, use its ones.
+		if err := r.Client.Get(ctx, r.SecretKey, &secret); err != nil {
+			return nil, err
+		}
+		return &secret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// needsRotation reports whether the certificates are missing, invalid, or expire
+// within RotateBefore.
+func (r *Rotator) needsRotation(data map[string][]byte, now time.Time) bool {
+	ca, _, err := parseKeyPair(data[CACertKey], data[CAKeyKey])
+	if err != nil || now.Add(r.RotateBefore).After(ca.NotAfter) {
+		return true
+	}
+	cert, _, err := parseKeyPair(data[CertKey], data[KeyKey])
+	if err != nil || now.Add(r.RotateBefore).After(cert.NotAfter) {
+		return true
+	}
+	return cert.CheckSignatureFrom(ca) != nil
+}
+
+// generate issues a new serving certificate, reusing the CA in data while it is valid.
+func (r *Rotator) generate(data map[string][]byte, now time.Time) (map[string][]byte, error) {
+	ca, caKey, err := parseKeyPair(data[CACertKey], data[CAKeyKey])
+	if err != nil || now.Add(r.RotateBefore).After(ca.NotAfter) {
+		if ca, caKey, err = newCA(now); err != nil {
+			return nil, err
+		}
+	}
+
+	service := fmt.Sprintf("%s.%s.svc", r.ServiceName, r.SecretKey.Namespace)
+	template := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: service},
+		DNSNames:     []string{r.ServiceName, service, service + ".cluster.local"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(r.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		CACertKey: encodeCert(ca.Raw),
+		CAKeyKey:  encodeKey(caKey),
+		CertKey:   encodeCert(der),
+		KeyKey:    encodeKey(key),
+	}, nil
+}
+
+func (r *Rotator) writeCertDir(secret *corev1.Secret) error {
+	if err := os.MkdirAll(r.CertDir, 0o700); err != nil {
+		return err
+	}
+	for _, key := range []string{CertKey, KeyKey} {
+		path := filepath.Join(r.CertDir, key)
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, secret.Data[key]) {
+			continue
+		}
+		// Write then rename so the webhook server never reads a partial file.
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, secret.Data[key], 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rotator) injectCABundle(ctx context.Context, caBundle []byte) error {
+	for _, name := range r.ValidatingWebhooks {
+		var config admissionregistrationv1.ValidatingWebhookConfiguration
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: name}, &config); err != nil {
+			return fmt.Errorf("failed to get ValidatingWebhookConfiguration %s: %w", name, err)
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if changed {
+			if err := r.Client.Update(ctx, &config); err != nil {
+				return fmt.Errorf("failed to inject CA in ValidatingWebhookConfiguration %s: %w", name, err)
+			}
+		}
+	}
+
+	for _, name := range r.MutatingWebhooks {
+		var config admissionregistrationv1.MutatingWebhookConfiguration
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: name}, &config); err != nil {
+			return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %w", name, err)
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if changed {
+			if err := r.Client.Update(ctx, &config); err != nil {
+				return fmt.Errorf("failed to inject CA in MutatingWebhookConfiguration %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func newCA(now time.Time) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "vpauto-creation-controller-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("missing certificate or key")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func newSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
@@ -0,0 +1,114 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/certs"
+)
+
+func newRotator(t *testing.T, objs ...client.Object) (*certs.Rotator, client.Client) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "validating"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "vworkload.vpacreation.com"}, {Name: "vvpa.vpacreation.com"}},
+	}
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "mutating"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mworkload.vpacreation.com"}},
+	}
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, validating, mutating)...).Build()
+
+	return &certs.Rotator{
+		Client:             fakeClient,
+		SecretKey:          client.ObjectKey{Namespace: "vpa-system", Name: "webhook-server-cert"},
+		ServiceName:        "webhook-service",
+		CertDir:            t.TempDir(),
+		ValidatingWebhooks: []string{"validating"},
+		MutatingWebhooks:   []string{"mutating"},
+		Validity:           certs.DefaultValidity,
+		RotateBefore:       certs.DefaultRotateBefore,
+		CheckInterval:      certs.DefaultCheckInterval,
+	}, fakeClient
+}
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestRotator_GeneratesCertificates(t *testing.T) {
+	r, c := newRotator(t)
+
+	require.NoError(t, r.EnsureCerts(context.TODO()))
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(context.TODO(), r.SecretKey, &secret))
+	ca := parseCert(t, secret.Data[certs.CACertKey])
+	cert := parseCert(t, secret.Data[certs.CertKey])
+	assert.True(t, ca.IsCA)
+	assert.NoError(t, cert.CheckSignatureFrom(ca))
+	assert.Contains(t, cert.DNSNames, "webhook-service.vpa-system.svc")
+
+	// The webhook server must be able to load the written key pair.
+	_, err := tls.LoadX509KeyPair(filepath.Join(r.CertDir, "tls.crt"), filepath.Join(r.CertDir, "tls.key"))
+	assert.NoError(t, err)
+
+	var validating admissionregistrationv1.ValidatingWebhookConfiguration
+	require.NoError(t, c.Get(context.TODO(), client.ObjectKey{Name: "validating"}, &validating))
+	for _, w := range validating.Webhooks {
+		assert.Equal(t, secret.Data[certs.CACertKey], w.ClientConfig.CABundle)
+	}
+	var mutating admissionregistrationv1.MutatingWebhookConfiguration
+	require.NoError(t, c.Get(context.TODO(), client.ObjectKey{Name: "mutating"}, &mutating))
+	assert.Equal(t, secret.Data[certs.CACertKey], mutating.Webhooks[0].ClientConfig.CABundle)
+
+	// Valid certificates are kept as is.
+	require.NoError(t, r.EnsureCerts(context.TODO()))
+	var again corev1.Secret
+	require.NoError(t, c.Get(context.TODO(), r.SecretKey, &again))
+	assert.Equal(t, secret.Data, again.Data)
+}
+
+func TestRotator_RotatesBeforeExpiry(t *testing.T) {
+	r, c := newRotator(t)
+	require.NoError(t, r.EnsureCerts(context.TODO()))
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(context.TODO(), r.SecretKey, &secret))
+
+	// A serving certificate expiring within RotateBefore is renewed with the same CA.
+	r.RotateBefore = r.Validity + time.Hour
+	r.Validity = 2 * r.Validity
+	require.NoError(t, r.EnsureCerts(context.TODO()))
+
+	var rotated corev1.Secret
+	require.NoError(t, c.Get(context.TODO(), r.SecretKey, &rotated))
+	assert.Equal(t, secret.Data[certs.CACertKey], rotated.Data[certs.CACertKey])
+	assert.NotEqual(t, secret.Data[certs.CertKey], rotated.Data[certs.CertKey])
+
+	written, err := os.ReadFile(filepath.Join(r.CertDir, "tls.crt"))
+	require.NoError(t, err)
+	assert.Equal(t, rotated.Data[certs.CertKey], written)
+}
@@ -0,0 +1,237 @@
+// Package config loads, validates and watches the configuration file of the
+// controller.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// APIVersion and Kind identify the version of the configuration file format.
+const (
+	APIVersion = "config.vpacreation.com/v1alpha1"
+	Kind       = "ControllerConfiguration"
+)
+
+// DefaultNamingTemplate names the VPA of a workload <name>-vpa.
+const DefaultNamingTemplate = "{{ .Name }}-vpa"
+
+// Configuration is the content of the configuration file. Fields left out of the
+// file keep the value given by the command-line flags.
+type Configuration struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// AnnotationPrefix is the prefix of the workload annotations read by the
+	// controllers, ending with a slash.
+	AnnotationPrefix string `json:"annotationPrefix,omitempty"`
+	// PreviousAnnotationPrefixes are the prefixes the controller used before
+	// AnnotationPrefix. Their finalizers are removed from the workloads, and the
+	// VPAs of the workloads they labelled are managed under AnnotationPrefix.
+	PreviousAnnotationPrefixes []string `json:"previousAnnotationPrefixes,omitempty"`
+	// DefaultUpdateMode is the update mode of the VPAs of the workloads without
+	// the update-mode annotation.
+	DefaultUpdateMode string `json:"defaultUpdateMode,omitempty"`
+	// NamingTemplate is the text/template the name of the VPA of a workload is
+	// rendered from, given its .Name, .Namespace and lowercase .Kind.
+	NamingTemplate string `json:"namingTemplate,omitempty"`
+	// ExcludedContainers are the names of the containers the VPAs give no
+	// recommendation for, such as sidecars.
+	ExcludedContainers []string `json:"excludedContainers,omitempty"`
+	// Namespaces restricts the namespaces the controllers watch.
+	Namespaces Namespaces `json:"namespaces,omitempty"`
+	// GCInterval is the time between two cleanups of the orphaned VPAs, including
+	// the retained VPAs whose TTL has elapsed. Zero uses a minute.
+	GCInterval metav1.Duration `json:"gcInterval,omitempty"`
+	// Profiles map the profiles of the config annotation of the workloads to the
+	// recommenders of their VPA. Other profiles select the recommender of the same name.
+	Profiles map[string][]string `json:"profiles,omitempty"`
+
+	naming *template.Template
+}
+
+// Namespaces restricts the namespaces the controllers watch.
+type Namespaces struct {
+	// Watch lists the namespaces to watch. Empty watches every namespace.
+	Watch []string `json:"watch,omitempty"`
+	// Exclude lists namespaces never to watch, even if they are in Watch.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Default returns the configuration used without configuration file.
+func Default() *Configuration {
+	c := &Configuration{
+		APIVersion:        APIVersion,
+		Kind:              Kind,
+		AnnotationPrefix:  annotations.Prefix,
+		DefaultUpdateMode: "Off",
+		NamingTemplate:    DefaultNamingTemplate,
+	}
+	c.naming = template.Must(template.New("naming").Option("missingkey=error").Parse(c.NamingTemplate))
+	return c
+}
+
+// Load reads the configuration file at path over the base configuration and
+// validates it. Unknown fields are rejected.
+func Load(path string, base *Configuration) (*Configuration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, base)
+}
+
+// Parse reads a configuration document over the base configuration and validates it.
+func Parse(data []byte, base *Configuration) (*Configuration, error) {
+	c := base.DeepCopy()
+	c.APIVersion, c.Kind = "", ""
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if errs := c.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %w", errs.ToAggregate())
+	}
+	return c, nil
+}
+
+// Validate checks the configuration, and compiles its naming template.
+func (c *Configuration) Validate() field.ErrorList {
+	var errs field.ErrorList
+
+	if c.APIVersion != APIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{APIVersion}))
+	}
+	if c.Kind != Kind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{Kind}))
+	}
+	if err := annotations.ValidatePrefix(field.NewPath("annotationPrefix"), c.AnnotationPrefix); err != nil {
+		errs = append(errs, err)
+	}
+	for i, prefix := range c.PreviousAnnotationPrefixes {
+		path := field.NewPath("previousAnnotationPrefixes").Index(i)
+		if err := annotations.ValidatePrefix(path, prefix); err != nil {
+			errs = append(errs, err)
+		} else if prefix == c.AnnotationPrefix {
+			errs = append(errs, field.Invalid(path, prefix, "must not be the annotationPrefix"))
+		}
+	}
+	if !slices.Contains(annotations.UpdateModes, c.DefaultUpdateMode) {
+		errs = append(errs, field.NotSupported(field.NewPath("defaultUpdateMode"), c.DefaultUpdateMode, annotations.UpdateModes))
+	}
+	errs = append(errs, c.compileNamingTemplate(field.NewPath("namingTemplate"))...)
+	errs = append(errs, validateNames(field.NewPath("excludedContainers"), c.ExcludedContainers)...)
+	errs = append(errs, validateNames(field.NewPath("namespaces", "watch"), c.Namespaces.Watch)...)
+	errs = append(errs, validateNames(field.NewPath("namespaces", "exclude"), c.Namespaces.Exclude)...)
+	if c.GCInterval.Duration < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("gcInterval"), c.GCInterval.Duration.String(), "must not be negative"))
+	}
+	for _, profile := range slices.Sorted(maps.Keys(c.Profiles)) {
+		path := field.NewPath("profiles").Key(profile)
+		if msgs := validation.IsDNS1123Label(profile); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path, profile, strings.Join(msgs, "; ")))
+		}
+		if len(c.Profiles[profile]) == 0 {
+			errs = append(errs, field.Required(path, "must list at least one recommender"))
+		}
+		errs = append(errs, validateNames(path, c.Profiles[profile])...)
+	}
+	return errs
+}
+
+// compileNamingTemplate parses the naming template and checks it renders valid
+// names, different for different workloads.
+func (c *Configuration) compileNamingTemplate(path *field.Path) field.ErrorList {
+	naming, err := template.New("naming").Option("missingkey=error").Parse(c.NamingTemplate)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, c.NamingTemplate, err.Error())}
+	}
+	c.naming = naming
+
+	names := map[string]bool{}
+	for _, workload := range []string{"web", "worker"} {
+		name, err := c.VPAName(workload, "default", "Deployment")
+		if err != nil {
+			return field.ErrorList{field.Invalid(path, c.NamingTemplate, err.Error())}
+		}
+		if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+			return field.ErrorList{field.Invalid(path, c.NamingTemplate,
+				fmt.Sprintf("renders %q: %s", name, strings.Join(msgs, "; ")))}
+		}
+		names[name] = true
+	}
+	if len(names) < 2 {
+		return field.ErrorList{field.Invalid(path, c.NamingTemplate, "must render a different name for each workload, e.g. with {{ .Name }}")}
+	}
+	return nil
+}
+
+// VPAName renders the naming template for a workload.
+func (c *Configuration) VPAName(name, namespace, kind string) (string, error) {
+	if c.naming == nil {
+		return "", fmt.Errorf("naming template not validated")
+	}
+	var b bytes.Buffer
+	err := c.naming.Execute(&b, struct{ Name, Namespace, Kind string }{name, namespace, strings.ToLower(kind)})
+	return b.String(), err
+}
+
+// Recommenders returns the recommenders selected by a profile of the config
+// annotation of a workload.
+func (c *Configuration) Recommenders(profile string) []string {
+	if recommenders, ok := c.Profiles[profile]; ok {
+		return recommenders
+	}
+	return []string{profile}
+}
+
+// Keys returns the workload annotations under the annotation prefix.
+func (c *Configuration) Keys() annotations.Keys {
+	return annotations.KeysFor(c.AnnotationPrefix)
+}
+
+// PreviousKeys returns the annotations under the previous annotation prefixes.
+func (c *Configuration) PreviousKeys() []annotations.Keys {
+	keys := make([]annotations.Keys, 0, len(c.PreviousAnnotationPrefixes))
+	for _, prefix := range c.PreviousAnnotationPrefixes {
+		keys = append(keys, annotations.KeysFor(prefix))
+	}
+	return keys
+}
+
+// DeepCopy returns a copy of the configuration.
+func (c *Configuration) DeepCopy() *Configuration {
+	out := *c
+	out.PreviousAnnotationPrefixes = slices.Clone(c.PreviousAnnotationPrefixes)
+	out.ExcludedContainers = slices.Clone(c.ExcludedContainers)
+	out.Namespaces.Watch = slices.Clone(c.Namespaces.Watch)
+	out.Namespaces.Exclude = slices.Clone(c.Namespaces.Exclude)
+	if c.Profiles != nil {
+		out.Profiles = make(map[string][]string, len(c.Profiles))
+		for profile, recommenders := range c.Profiles {
+			out.Profiles[profile] = slices.Clone(recommenders)
+		}
+	}
+	return &out
+}
+
+func validateNames(path *field.Path, names []string) field.ErrorList {
+	var errs field.ErrorList
+	for i, name := range names {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path.Index(i), name, strings.Join(msgs, "; ")))
+		}
+	}
+	return errs
+}
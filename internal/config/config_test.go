@@ -0,0 +1,99 @@
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+)
+
+func TestParse(t *testing.T) {
+	base := config.Default()
+	base.Namespaces.Exclude = []string{"kube-system"}
+
+	c, err := config.Parse([]byte(`
+apiVersion: config.vpacreation.com/v1alpha1
+kind: ControllerConfiguration
+defaultUpdateMode: Auto
+namingTemplate: "{{ .Namespace }}-{{ .Name }}-{{ .Kind }}"
+excludedContainers: [istio-proxy, linkerd-proxy]
+gcInterval: 10m
+`), base)
+	require.NoError(t, err)
+
+	assert.Equal(t, "k8s.autoscaling.vpacreation/", c.AnnotationPrefix)
+	assert.Equal(t, "Auto", c.DefaultUpdateMode)
+	assert.Equal(t, []string{"istio-proxy", "linkerd-proxy"}, c.ExcludedContainers)
+	assert.Equal(t, []string{"kube-system"}, c.Namespaces.Exclude, "fields left out keep their base value")
+	assert.Equal(t, 10*time.Minute, c.GCInterval.Duration)
+
+	name, err := c.VPAName("web", "shop", "StatefulSet")
+	require.NoError(t, err)
+	assert.Equal(t, "shop-web-statefulset", name)
+
+	name, err = config.Default().VPAName("web", "shop", "Deployment")
+	require.NoError(t, err)
+	assert.Equal(t, "web-vpa", name)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{name: "missing version", doc: "kind: ControllerConfiguration", want: "apiVersion"},
+		{name: "other version", doc: "apiVersion: config.vpacreation.com/v2\nkind: ControllerConfiguration", want: "apiVersion"},
+		{name: "unknown field", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nupdateMode: Auto", want: "updateMode"},
+		{name: "prefix without slash", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nannotationPrefix: example.com", want: "annotationPrefix"},
+		{name: "update mode", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\ndefaultUpdateMode: Always", want: "defaultUpdateMode"},
+		{name: "template syntax", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nnamingTemplate: \"{{ .Name \"", want: "namingTemplate"},
+		{name: "template field", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nnamingTemplate: \"{{ .Owner }}\"", want: "namingTemplate"},
+		{name: "constant name", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nnamingTemplate: vpa", want: "different name"},
+		{name: "invalid name", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nnamingTemplate: \"{{ .Name }}_vpa\"", want: "namingTemplate"},
+		{name: "container name", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nexcludedContainers: [Istio]", want: "excludedContainers[0]"},
+		{name: "namespace", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nnamespaces: {watch: [team_a]}", want: "namespaces.watch[0]"},
+		{name: "negative interval", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\ngcInterval: -1m", want: "gcInterval"},
+		{name: "previous prefix", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\npreviousAnnotationPrefixes: [k8s.autoscaling.vpacreation/]", want: "previousAnnotationPrefixes[0]"},
+		{name: "profile without recommender", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nprofiles: {frugal: []}", want: "profiles[frugal]"},
+		{name: "recommender name", doc: "apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\nprofiles: {frugal: [Frugal]}", want: "profiles[frugal][0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := config.Parse([]byte(tt.doc), config.Default())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestWatcher_ReloadsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(doc string) {
+		require.NoError(t, os.WriteFile(path, []byte("apiVersion: config.vpacreation.com/v1alpha1\nkind: ControllerConfiguration\n"+doc), 0o600))
+	}
+	write("defaultUpdateMode: Initial\n")
+
+	base := config.Default()
+	initial, err := config.Load(path, base)
+	require.NoError(t, err)
+	store := config.NewStore(initial)
+	changed := store.Subscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = (&config.Watcher{Path: path, Base: base, Store: store}).Start(ctx) }()
+
+	// The file is written until the watcher, started asynchronously, sees it.
+	assert.Eventually(t, func() bool {
+		write("defaultUpdateMode: Auto\n")
+		return store.Get().DefaultUpdateMode == "Auto"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Len(t, changed, 1)
+}
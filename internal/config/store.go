@@ -0,0 +1,47 @@
+package config
+
+import "sync"
+
+// Store holds the current configuration and notifies its subscribers when it
+// changes.
+type Store struct {
+	mu          sync.RWMutex
+	current     *Configuration
+	subscribers []chan struct{}
+}
+
+// NewStore returns a store holding the configuration.
+func NewStore(c *Configuration) *Store {
+	return &Store{current: c}
+}
+
+// Get returns the current configuration, which must not be modified.
+func (s *Store) Get() *Configuration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// Set replaces the current configuration and notifies the subscribers.
+func (s *Store) Set(c *Configuration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = c
+	for _, ch := range s.subscribers {
+		// A pending notification already covers this change.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving a value after the configuration changes.
+// Changes made while the previous one is not received yet are coalesced.
+func (s *Store) Subscribe() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	s.subscribers = append(s.subscribers, ch)
+	return ch
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Watcher reloads the configuration file into the store when it changes. Invalid
+// changes are logged and ignored, the previous configuration is kept.
+type Watcher struct {
+	// Path is the configuration file.
+	Path string
+	// Base is the configuration the file is read over.
+	Base *Configuration
+	// Store receives the reloaded configuration.
+	Store *Store
+}
+
+// Start watches the configuration file until the context is done. The directory
+// of the file is watched, as a mounted ConfigMap is updated by swapping symlinks.
+func (w *Watcher) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("config")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Close() }()
+	if err := watcher.Add(filepath.Dir(w.Path)); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			logger.Error(err, "Failed to watch configuration file", "path", w.Path)
+		case <-watcher.Events:
+			w.reload(ctx)
+		}
+	}
+}
+
+// NeedLeaderElection is false, every replica must follow the configuration.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *Watcher) reload(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("config")
+
+	c, err := Load(w.Path, w.Base)
+	if err != nil {
+		logger.Error(err, "Ignoring invalid configuration file", "path", w.Path)
+		return
+	}
+	current := w.Store.Get()
+	if reflect.DeepEqual(c.withoutTemplate(), current.withoutTemplate()) {
+		return
+	}
+	logger.Info("Reloaded configuration file", "path", w.Path)
+	w.Store.Set(c)
+}
+
+// withoutTemplate returns a copy of the configuration without its compiled
+// naming template, for comparison.
+func (c *Configuration) withoutTemplate() Configuration {
+	out := *c.DeepCopy()
+	out.naming = nil
+	return out
+}
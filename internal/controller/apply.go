@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/rest"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// applyVPA creates or updates the managed VPA of the workload with server-side
+// apply, as the field manager of the controller instance. The controller only
+// owns the fields it sets, the rest of the VPA is left to other tools. Fields
+// owned by another manager are not overwritten: the conflict is reported on the
+// workload instead. Fields last written by the controller itself, by its merge
+// patches or by earlier versions, are taken over. It returns whether the apply
+// went through.
+func (r *VPAControllerReconciler) applyVPA(ctx context.Context, obj client.Object, vpa *autoscalingv1.VerticalPodAutoscaler) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	keys := currentKeys(r.Config)
+	owner := client.FieldOwner(keys.ManagedByValue)
+	err := r.Client.Patch(ctx, vpa, client.Apply, owner)
+	if errors.IsConflict(err) && ownConflict(err, r.ownFieldManagers()) {
+		logger.V(1).Info("Taking over VPA fields written by the controller", "name", vpa.Name, "conflict", err.Error())
+		err = r.Client.Patch(ctx, vpa, client.Apply, owner, client.ForceOwnership)
+	}
+	if err != nil {
+		if !errors.IsConflict(err) {
+			return false, err
+		}
+		logger.Info("VPA fields are owned by another manager, not overwriting them", "name", vpa.Name, "conflict", err.Error())
+		r.Recorder.Event(obj, corev1.EventTypeWarning, "VPAApplyConflict",
+			fmt.Sprintf("Not updating VPA %s, its fields are managed by someone else: %v", vpa.Name, err))
+		r.Metrics.VPAApplyConflicts.WithLabelValues(getKind(obj), vpa.Namespace).Inc()
+		return false, nil
+	}
+	return true, nil
+}
+
+// legacyFieldManager is the field manager the API server records for writes
+// made without one: the program name at the start of the user agent. Earlier
+// versions of the controller created and patched their VPAs under it.
+var legacyFieldManager, _, _ = strings.Cut(rest.DefaultKubernetesUserAgent(), "/")
+
+// ownFieldManagers returns the field managers the controller instance writes
+// its VPAs under, including the ones of the previous annotation prefixes, so the
+// first apply after a VPA is migrated takes over the fields applied before.
+func (r *VPAControllerReconciler) ownFieldManagers() []string {
+	cfg := currentConfig(r.Config)
+	managers := []string{cfg.Keys().ManagedByValue, legacyFieldManager}
+	for _, prev := range cfg.PreviousKeys() {
+		managers = append(managers, prev.ManagedByValue)
+	}
+	return managers
+}
+
+// patchVPA patches the VPA under the field manager of the controller instance,
+// so that applyVPA recognises the fields as written by the controller.
+func patchVPA(ctx context.Context, c client.Client, vpa *autoscalingv1.VerticalPodAutoscaler, patch client.Patch, keys annotations.Keys) error {
+	return c.Patch(ctx, vpa, patch, client.FieldOwner(keys.ManagedByValue))
+}
+
+// conflictManager extracts the field manager from the message of a conflict
+// cause, such as `conflict with "kubectl-edit" using autoscaling.k8s.io/v1`.
+var conflictManager = regexp.MustCompile(`^conflict with "([^"]*)"`)
+
+// ownConflict reports whether every field of the apply conflict is owned by one
+// of the managers.
+func ownConflict(err error, managers []string) bool {
+	status, ok := err.(errors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return false
+	}
+	found := false
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		m := conflictManager.FindStringSubmatch(cause.Message)
+		if m == nil || !slices.Contains(managers, m[1]) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// upToDate reports whether the fields the controller sets on the VPA already have
+// their desired values, in which case there is nothing to apply. The container
+// policies and recommenders are only set by the controller for the VPAs
+// configured by the config annotation of their workload.
+func upToDate(current, desired *autoscalingv1.VerticalPodAutoscaler, keys annotations.Keys) bool {
+	for k, v := range desired.Labels {
+		if current.Labels[k] != v {
+			return false
+		}
+	}
+	for k, v := range desired.Annotations {
+		if current.Annotations[k] != v {
+			return false
+		}
+	}
+	currentOwner, desiredOwner := metav1.GetControllerOf(current), metav1.GetControllerOf(desired)
+	if currentOwner == nil || desiredOwner == nil || currentOwner.UID != desiredOwner.UID {
+		return false
+	}
+	if configured(current, keys) || configured(desired, keys) {
+		if _, ok := desired.Annotations[keys.Config]; !ok {
+			return false
+		}
+		if !equality.Semantic.DeepEqual(normalizeResourcePolicy(current.Spec.ResourcePolicy), normalizeResourcePolicy(desired.Spec.ResourcePolicy)) ||
+			!equality.Semantic.DeepEqual(current.Spec.Recommenders, desired.Spec.Recommenders) {
+			return false
+		}
+	}
+	return equality.Semantic.DeepEqual(current.Spec.TargetRef, desired.Spec.TargetRef) &&
+		equality.Semantic.DeepEqual(current.Spec.UpdatePolicy, desired.Spec.UpdatePolicy)
+}
+
+// desiredVPA returns the VPA to apply for the workload. The fields set by the
+// controller after creation, such as its creation time or a downgraded update
+// mode, are carried over from the current VPA so applying does not revert them.
+// The container policies of a VPA configured by the config annotation carry
+// over the adjustments of the controller as well.
+func (r *VPAControllerReconciler) desiredVPA(obj client.Object, wc *annotations.WorkloadConfig, name string, current *autoscalingv1.VerticalPodAutoscaler) autoscalingv1.VerticalPodAutoscaler {
+	vpa := r.generateVPA(name, obj.GetNamespace(), getKind(obj), obj, wc)
+	keys := currentKeys(r.Config)
+
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	if current != nil {
+		if v, ok := current.Annotations[keys.CreatedAt]; ok {
+			createdAt = v
+		}
+		if configured(current, keys) || configured(&vpa, keys) {
+			keepControllerAdjustments(current, &vpa, keys)
+		} else if _, ok := current.Annotations[keys.DowngradedFrom]; ok {
+			initial := autoscalingv1.UpdateModeInitial
+			vpa.Spec.UpdatePolicy.UpdateMode = &initial
+		}
+	}
+	metav1.SetMetaDataAnnotation(&vpa.ObjectMeta, keys.CreatedAt, createdAt)
+	return vpa
+}
@@ -0,0 +1,106 @@
+package controller_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// TestEnvtest_AppliesOverVPACreatedByEarlierVersions runs against a real API
+// server, as field ownership is not enforced by the fake client. It is skipped
+// unless the envtest binaries are set up, as done by make test.
+func TestEnvtest_AppliesOverVPACreatedByEarlierVersions(t *testing.T) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS is not set")
+	}
+	scheme := setupScheme(t)
+
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "test", "crd")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, env.Stop()) })
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress: "0",
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, controller.SetupIndexes(ctx, mgr.GetFieldIndexer()))
+	go func() { _ = mgr.Start(ctx) }()
+	require.True(t, mgr.GetCache().WaitForCacheSync(ctx))
+	c := mgr.GetClient()
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+				"k8s.autoscaling.vpacreation/update-mode": "Initial",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+			},
+		},
+	}
+	require.NoError(t, c.Create(ctx, dep))
+
+	// Earlier versions created the VPA with Create, under the default field manager.
+	vpa := managedVPA("web-vpa", dep)
+	vpa.CreationTimestamp = metav1.Time{}
+	vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeInitial)}
+	require.NoError(t, c.Create(ctx, vpa))
+
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAControllerReconciler{
+		Client:   c,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: recorder,
+	}
+
+	dep.Annotations["k8s.autoscaling.vpacreation/update-mode"] = "Auto"
+	require.NoError(t, c.Update(ctx, dep))
+
+	require.Eventually(t, func() bool {
+		if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(dep)}); err != nil {
+			return false
+		}
+		var got autoscalingv1.VerticalPodAutoscaler
+		if err := mgr.GetAPIReader().Get(ctx, client.ObjectKeyFromObject(vpa), &got); err != nil {
+			return false
+		}
+		return got.Spec.UpdatePolicy != nil && *got.Spec.UpdatePolicy.UpdateMode == autoscalingv1.UpdateModeAuto
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Empty(t, recorder.Events)
+}
@@ -0,0 +1,154 @@
+package controller_test
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// benchmarkWorkloads is the number of workloads held in the cache by BenchmarkWorkloadCache.
+const benchmarkWorkloads = 10000
+
+// benchmarkManagedFields are the managed fields of a Deployment applied by a
+// client and scaled by the deployment controller, as returned by the API server.
+var benchmarkManagedFields = []metav1.ManagedFieldsEntry{
+	{
+		Manager:    "kubectl-client-side-apply",
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		APIVersion: "apps/v1",
+		FieldsType: "FieldsV1",
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{".":{},"f:k8s.autoscaling.vpacreation/vpa-enabled":{}},` +
+			`"f:labels":{".":{},"f:app":{},"f:team":{}}},"f:spec":{"f:progressDeadlineSeconds":{},"f:replicas":{},` +
+			`"f:revisionHistoryLimit":{},"f:selector":{},"f:strategy":{"f:rollingUpdate":{".":{},"f:maxSurge":{},"f:maxUnavailable":{}},"f:type":{}},` +
+			`"f:template":{"f:metadata":{"f:labels":{".":{},"f:app":{},"f:team":{}}},"f:spec":{"f:containers":{` +
+			`"k:{\"name\":\"app\"}":{".":{},"f:args":{},"f:env":{".":{},"k:{\"name\":\"LOG_LEVEL\"}":{".":{},"f:name":{},"f:value":{}},` +
+			`"k:{\"name\":\"POD_NAME\"}":{".":{},"f:name":{},"f:valueFrom":{".":{},"f:fieldRef":{}}}},"f:image":{},"f:imagePullPolicy":{},"f:name":{},` +
+			`"f:ports":{".":{},"k:{\"containerPort\":8080,\"protocol\":\"TCP\"}":{".":{},"f:containerPort":{},"f:name":{},"f:protocol":{}}},` +
+			`"f:readinessProbe":{".":{},"f:httpGet":{".":{},"f:path":{},"f:port":{},"f:scheme":{}}},"f:resources":{".":{},"f:limits":{".":{},"f:memory":{}},` +
+			`"f:requests":{".":{},"f:cpu":{},"f:memory":{}}},"f:volumeMounts":{".":{},"k:{\"mountPath\":\"/etc/app\"}":{".":{},"f:mountPath":{},"f:name":{}}}},` +
+			`"k:{\"name\":\"proxy\"}":{".":{},"f:args":{},"f:image":{},"f:name":{},"f:resources":{".":{},"f:requests":{".":{},"f:cpu":{},"f:memory":{}}}}},` +
+			`"f:dnsPolicy":{},"f:restartPolicy":{},"f:schedulerName":{},"f:terminationGracePeriodSeconds":{},` +
+			`"f:volumes":{".":{},"k:{\"name\":\"config\"}":{".":{},"f:configMap":{".":{},"f:name":{}},"f:name":{}}}}}}}`)},
+	},
+	{
+		Manager:     "kube-controller-manager",
+		Operation:   metav1.ManagedFieldsOperationUpdate,
+		APIVersion:  "apps/v1",
+		FieldsType:  "FieldsV1",
+		Subresource: "status",
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:deployment.kubernetes.io/revision":{}}},` +
+			`"f:status":{"f:availableReplicas":{},"f:conditions":{".":{},"k:{\"type\":\"Available\"}":{".":{},"f:lastTransitionTime":{},` +
+			`"f:lastUpdateTime":{},"f:message":{},"f:reason":{},"f:status":{},"f:type":{}},"k:{\"type\":\"Progressing\"}":{".":{},` +
+			`"f:lastTransitionTime":{},"f:lastUpdateTime":{},"f:message":{},"f:reason":{},"f:status":{},"f:type":{}}},` +
+			`"f:observedGeneration":{},"f:readyReplicas":{},"f:replicas":{},"f:updatedReplicas":{}}}`)},
+	},
+}
+
+// benchmarkDeployment returns an opted-in Deployment with a typical pod template
+// and managed fields.
+func benchmarkDeployment(i int) *appsv1.Deployment {
+	name := fmt.Sprintf("web-%d", i)
+	labels := map[string]string{"app": name, "team": "payments"}
+	container := func(name, image string) corev1.Container {
+		return corev1.Container{
+			Name:  name,
+			Image: image,
+			Args:  []string{"--port=8080", "--log-format=json"},
+			Env: []corev1.EnvVar{
+				{Name: "LOG_LEVEL", Value: "info"},
+				{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+			},
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("128Mi")},
+				Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+			},
+			ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/healthz"}}},
+			VolumeMounts:   []corev1.VolumeMount{{Name: "config", MountPath: "/etc/" + name}},
+		}
+	}
+
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   fmt.Sprintf("team-%d", i%100),
+			UID:         types.UID(fmt.Sprintf("uid-%d", i)),
+			Labels:      labels,
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+			ManagedFields: func() []metav1.ManagedFieldsEntry {
+				// Every object decoded from the API server holds its own copy.
+				fields := make([]metav1.ManagedFieldsEntry, len(benchmarkManagedFields))
+				for i, entry := range benchmarkManagedFields {
+					entry.FieldsV1 = &metav1.FieldsV1{Raw: append([]byte(nil), entry.FieldsV1.Raw...)}
+					fields[i] = entry
+				}
+				return fields
+			}(),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{container("app", "registry.example.com/web:1.0.0"), container("proxy", "envoyproxy/envoy:v1.30")},
+					Volumes:    []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}}}}},
+				},
+			},
+		},
+	}
+}
+
+// BenchmarkWorkloadCache reports the heap held by a cache of 10k Deployments,
+// when their full objects are cached, when only their metadata is, and when
+// their managed fields are also stripped by the transform of the manager cache
+// before they are stored, as the informers do.
+func BenchmarkWorkloadCache(b *testing.B) {
+	stripManagedFields := cache.TransformStripManagedFields()
+	for _, bc := range []struct {
+		name    string
+		convert func(*appsv1.Deployment) (any, error)
+	}{
+		{name: "Full", convert: func(d *appsv1.Deployment) (any, error) { return d, nil }},
+		{name: "Metadata", convert: func(d *appsv1.Deployment) (any, error) { return meta.AsPartialObjectMetadata(d), nil }},
+		{name: "MetadataWithoutManagedFields", convert: func(d *appsv1.Deployment) (any, error) {
+			return stripManagedFields(meta.AsPartialObjectMetadata(d))
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var held uint64
+			for range b.N {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				store := toolscache.NewStore(toolscache.MetaNamespaceKeyFunc)
+				for i := range benchmarkWorkloads {
+					obj, err := bc.convert(benchmarkDeployment(i))
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := store.Add(obj); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				held += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(held)/float64(b.N)/(1<<20), "MiB/cache")
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+
+	appsv1 "k8s.io/api/apps/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// Backoff bounds the per-item exponential backoff of the retries of failed
+// reconciles. The zero value uses the controller-runtime defaults.
+type Backoff struct {
+	// Base is the delay before the first retry, doubled on every failure.
+	Base time.Duration
+	// Max is the longest delay between two retries.
+	Max time.Duration
+}
+
+// rateLimiter returns the rate limiter of a reconcile queue, or nil for the default one.
+func (b Backoff) rateLimiter() workqueue.TypedRateLimiter[reconcile.Request] {
+	if b == (Backoff{}) {
+		return nil
+	}
+	return workqueue.NewTypedMaxOfRateLimiter(
+		workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](b.Base, b.Max),
+		// Same overall limit as the default rate limiter of controller-runtime.
+		&workqueue.TypedBucketRateLimiter[reconcile.Request]{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// ParseKindConcurrency parses a comma-separated list of <kind>=<workers> pairs,
+// e.g. "Deployment=8,StatefulSet=2", into the number of concurrent reconciles of
+// each workload kind, keyed by group kind as in the GroupKindConcurrency option
+// of the manager.
+func ParseKindConcurrency(s string) (map[string]int, error) {
+	concurrency := map[string]int{}
+	for _, pair := range annotations.List(s) {
+		kind, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a <kind>=<workers> pair", pair)
+		}
+		kind = strings.TrimSpace(kind)
+		if !slices.Contains(workloadKinds, kind) {
+			return nil, fmt.Errorf("unsupported kind %q, must be one of %s", kind, strings.Join(workloadKinds, ", "))
+		}
+		workers, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || workers < 1 {
+			return nil, fmt.Errorf("invalid number of workers %q for %s, must be a positive integer", value, kind)
+		}
+		concurrency[appsv1.SchemeGroupVersion.WithKind(kind).GroupKind().String()] = workers
+	}
+	return concurrency, nil
+}
@@ -0,0 +1,25 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+)
+
+func TestParseKindConcurrency(t *testing.T) {
+	concurrency, err := controller.ParseKindConcurrency("Deployment=8, StatefulSet = 2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"Deployment.apps": 8, "StatefulSet.apps": 2}, concurrency)
+
+	concurrency, err = controller.ParseKindConcurrency("")
+	require.NoError(t, err)
+	assert.Empty(t, concurrency)
+
+	for _, invalid := range []string{"Deployment", "ReplicaSet=2", "Deployment=0", "Deployment=many"} {
+		_, err := controller.ParseKindConcurrency(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
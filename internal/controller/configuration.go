@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/util/workqueue"
+
+	appsv1 "k8s.io/api/apps/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+)
+
+// defaultConfig is the configuration of the reconcilers without configuration store.
+var defaultConfig = config.Default()
+
+// currentConfig returns the current configuration of the store, or the default one.
+func currentConfig(store *config.Store) *config.Configuration {
+	if store == nil {
+		return defaultConfig
+	}
+	return store.Get()
+}
+
+// currentKeys returns the annotations under the current annotation prefix.
+func currentKeys(store *config.Store) annotations.Keys {
+	return currentConfig(store).Keys()
+}
+
+// excludeContainers turns off the recommendations of the VPA for the excluded
+// containers of the configuration, and back on for the containers that are no
+// longer excluded, which are recorded in the excluded-containers annotation of
+// the VPA. The container policies are merge patched rather than applied,
+// as they are an atomic list the other adjustments of the controller also edit.
+func (r *VPAControllerReconciler) excludeContainers(ctx context.Context, vpa *autoscalingv1.VerticalPodAutoscaler) error {
+	keys := currentKeys(r.Config)
+	excluded := currentConfig(r.Config).ExcludedContainers
+	previous := annotations.List(vpa.Annotations[keys.ExcludedContainers])
+	if slices.Equal(excluded, previous) {
+		return nil
+	}
+
+	patch := client.MergeFrom(vpa.DeepCopy())
+	for _, name := range previous {
+		if !slices.Contains(excluded, name) {
+			includeContainer(vpa, name)
+		}
+	}
+	off := autoscalingv1.ContainerScalingModeOff
+	for _, name := range excluded {
+		containerPolicy(vpa, name).Mode = &off
+	}
+	if len(excluded) > 0 {
+		metav1.SetMetaDataAnnotation(&vpa.ObjectMeta, keys.ExcludedContainers, strings.Join(excluded, ","))
+	} else {
+		delete(vpa.Annotations, keys.ExcludedContainers)
+	}
+	if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Updated excluded containers of VPA", "name", vpa.Name, "containers", excluded)
+	return nil
+}
+
+// includeContainer turns the recommendations of the VPA back on for a container,
+// dropping its container policy if nothing else is left in it.
+func includeContainer(vpa *autoscalingv1.VerticalPodAutoscaler, container string) {
+	if vpa.Spec.ResourcePolicy == nil {
+		return
+	}
+	policies := vpa.Spec.ResourcePolicy.ContainerPolicies
+	for i := range policies {
+		if p := &policies[i]; p.ContainerName == container && p.Mode != nil && *p.Mode == autoscalingv1.ContainerScalingModeOff {
+			p.Mode = nil
+		}
+	}
+	vpa.Spec.ResourcePolicy.ContainerPolicies = slices.DeleteFunc(policies, func(p autoscalingv1.ContainerResourcePolicy) bool {
+		return equality.Semantic.DeepEqual(p, autoscalingv1.ContainerResourcePolicy{ContainerName: container})
+	})
+}
+
+// reloadSource enqueues the workloads of the kind selected by filter after the
+// configuration changes, so the new configuration is applied to them.
+func reloadSource(store *config.Store, reader client.Reader, kind string, filter func(client.Object) bool) source.Source {
+	changed := store.Subscribe()
+	return source.Func(func(ctx context.Context, queue workqueue.TypedRateLimitingInterface[reconcile.Request]) error {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+				}
+				var list metav1.PartialObjectMetadataList
+				list.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind(kind + "List"))
+				if err := reader.List(ctx, &list); err != nil {
+					log.FromContext(ctx).Error(err, "Failed to list workloads to apply the new configuration", "kind", kind)
+					continue
+				}
+				for i := range list.Items {
+					if obj := &list.Items[i]; filter(obj) {
+						queue.Add(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(obj)})
+					}
+				}
+			}
+		}()
+		return nil
+	})
+}
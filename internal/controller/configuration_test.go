@@ -0,0 +1,170 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func TestReconcile_AppliesConfiguration(t *testing.T) {
+	scheme := setupScheme(t)
+
+	cfg, err := config.Parse([]byte(`
+apiVersion: config.vpacreation.com/v1alpha1
+kind: ControllerConfiguration
+annotationPrefix: autoscaling.example.com/
+defaultUpdateMode: Initial
+namingTemplate: "{{ .Kind }}-{{ .Name }}"
+excludedContainers: [istio-proxy]
+`), config.Default())
+	require.NoError(t, err)
+	store := config.NewStore(cfg)
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{"autoscaling.example.com/vpa-enabled": "true"},
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
+		Config:  store,
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}}
+
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "deployment-web"}, &vpa))
+	assert.Equal(t, autoscalingv1.UpdateModeInitial, *vpa.Spec.UpdatePolicy.UpdateMode)
+	require.NotNil(t, vpa.Spec.ResourcePolicy)
+	require.Len(t, vpa.Spec.ResourcePolicy.ContainerPolicies, 1)
+	assert.Equal(t, "istio-proxy", vpa.Spec.ResourcePolicy.ContainerPolicies[0].ContainerName)
+	assert.Equal(t, autoscalingv1.ContainerScalingModeOff, *vpa.Spec.ResourcePolicy.ContainerPolicies[0].Mode)
+	assert.Equal(t, "istio-proxy", vpa.Annotations["autoscaling.example.com/excluded-containers"])
+
+	// Containers no longer excluded get their recommendations back.
+	reloaded := cfg.DeepCopy()
+	reloaded.ExcludedContainers = nil
+	store.Set(reloaded)
+
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "deployment-web"}, &vpa))
+	if vpa.Spec.ResourcePolicy != nil {
+		assert.Empty(t, vpa.Spec.ResourcePolicy.ContainerPolicies)
+	}
+	assert.NotContains(t, vpa.Annotations, "autoscaling.example.com/excluded-containers")
+}
+
+func TestReconcile_IgnoresAnnotationsOfOtherPrefix(t *testing.T) {
+	scheme := setupScheme(t)
+
+	cfg := config.Default()
+	cfg.AnnotationPrefix = "autoscaling.example.com/"
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
+		Config:  config.NewStore(cfg),
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	assert.Empty(t, vpas.Items)
+}
+
+func TestReconcile_InstancesWithDifferentPrefixes(t *testing.T) {
+	scheme := setupScheme(t)
+
+	tenant := config.Default()
+	tenant.AnnotationPrefix = "autoscaling.example.com/"
+	tenantKeys := tenant.Keys()
+
+	web := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name: "web", Namespace: "default", UID: "web-uid",
+		Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+	}}
+	api := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name: "api", Namespace: "default", UID: "api-uid",
+		Annotations: map[string]string{"autoscaling.example.com/vpa-enabled": "true"},
+	}}
+	retained := func(name, managedBy, retainedAt string) *autoscalingv1.VerticalPodAutoscaler {
+		return &autoscalingv1.VerticalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name, Namespace: "default",
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": managedBy},
+				Annotations: map[string]string{retainedAt: time.Now().UTC().Format(time.RFC3339)},
+			},
+			Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+				TargetRef: &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: name, APIVersion: "apps/v1"},
+			},
+		}
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(web, api,
+		retained("old", "vpauto-creation-controller", "k8s.autoscaling.vpacreation/retained-at"),
+		retained("tenant-old", tenantKeys.ManagedByValue, "autoscaling.example.com/retained-at"),
+	).WithInterceptorFuncs(applyAsMergePatch).Build()
+	instances := []*controller.VPAControllerReconciler{
+		{Client: fakeClient, Scheme: scheme, Metrics: metrics.NewCollectors(), RetainTTL: time.Hour},
+		{Client: fakeClient, Scheme: scheme, Metrics: metrics.NewCollectors(), RetainTTL: time.Hour, Config: config.NewStore(tenant)},
+	}
+	for _, r := range instances {
+		for _, name := range []string{"web", "api"} {
+			_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+			require.NoError(t, err)
+		}
+		gc := &controller.GarbageCollector{Client: fakeClient, Metrics: r.Metrics, RetainTTL: r.RetainTTL, Config: r.Config}
+		require.NoError(t, gc.Collect(context.TODO()))
+	}
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	managedBy := map[string]string{}
+	for _, vpa := range vpas.Items {
+		managedBy[vpa.Name] = vpa.Labels["app.kubernetes.io/managed-by"]
+	}
+	assert.Equal(t, map[string]string{
+		"web-vpa":    "vpauto-creation-controller",
+		"api-vpa":    tenantKeys.ManagedByValue,
+		"old":        "vpauto-creation-controller",
+		"tenant-old": tenantKeys.ManagedByValue,
+	}, managedBy)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "api-vpa"}, &vpa))
+	assert.Contains(t, vpa.Annotations, "autoscaling.example.com/created-at")
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// correctDrift reverts the spec fields of a managed VPA that differ from what
+// generateVPA produces for the workload, except the ones listed in the
+// drift-ignore annotation of the workload. Adjustments made by the controller
+// itself, such as a downgraded update mode or a raised memory floor, are kept.
+func (r *VPAControllerReconciler) correctDrift(ctx context.Context, obj client.Object, wc *annotations.WorkloadConfig, vpa *autoscalingv1.VerticalPodAutoscaler) error {
+	logger := log.FromContext(ctx)
+
+	keys := currentKeys(r.Config)
+	if !isManagedVPA(vpa, keys) {
+		return nil
+	}
+
+	kind := getKind(obj)
+	desired := r.generateVPA(vpa.Name, vpa.Namespace, kind, obj, wc)
+	keepControllerAdjustments(vpa, &desired, keys)
+
+	ignored := map[string]bool{}
+	for _, f := range annotations.List(obj.GetAnnotations()[keys.DriftIgnore]) {
+		ignored[f] = true
+	}
+
+	patch := client.MergeFrom(vpa.DeepCopy())
+	var reverted []string
+	if !equality.Semantic.DeepEqual(vpa.Spec.TargetRef, desired.Spec.TargetRef) {
+		vpa.Spec.TargetRef = desired.Spec.TargetRef
+		reverted = append(reverted, "targetRef")
+	}
+	if !ignored["updatePolicy"] && !equality.Semantic.DeepEqual(vpa.Spec.UpdatePolicy, desired.Spec.UpdatePolicy) {
+		vpa.Spec.UpdatePolicy = desired.Spec.UpdatePolicy
+		reverted = append(reverted, "updatePolicy")
+	}
+	if !ignored["resourcePolicy"] && !equality.Semantic.DeepEqual(normalizeResourcePolicy(vpa.Spec.ResourcePolicy), desired.Spec.ResourcePolicy) {
+		vpa.Spec.ResourcePolicy = desired.Spec.ResourcePolicy
+		reverted = append(reverted, "resourcePolicy")
+	}
+	if !ignored["recommenders"] && !equality.Semantic.DeepEqual(vpa.Spec.Recommenders, desired.Spec.Recommenders) {
+		vpa.Spec.Recommenders = desired.Spec.Recommenders
+		reverted = append(reverted, "recommenders")
+	}
+	if len(reverted) == 0 {
+		return nil
+	}
+
+	if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+		return err
+	}
+
+	logger.Info("Reverted manual edits of VPA", "name", vpa.Name, "fields", reverted)
+	r.Recorder.Event(obj, corev1.EventTypeWarning, "DriftReverted",
+		fmt.Sprintf("Reverted manual edits of VPA %s: %s", vpa.Name, strings.Join(reverted, ", ")))
+	for _, f := range reverted {
+		r.Metrics.VPADriftReverted.WithLabelValues(kind, vpa.Namespace, f).Inc()
+	}
+	return nil
+}
+
+// keepControllerAdjustments carries over to the desired VPA the changes the
+// controller made to the current one after creating it: a downgraded update mode,
+// excluded containers, and a minAllowed inherited from another VPA or raised
+// after OOM kills, as recorded in the annotations of the current VPA under the
+// keys. The container policies keep their current order.
+//
+// The floors set by the controller are merged per resource with the minAllowed
+// of the desired VPA, taking the highest within its maxAllowed. A minAllowed of
+// the current VPA that is not above the one of the config annotation it was
+// last applied with is the configured one rather than a floor of the
+// controller, so that lowering it in the annotation takes effect.
+func keepControllerAdjustments(current, desired *autoscalingv1.VerticalPodAutoscaler, keys annotations.Keys) {
+	if _, ok := current.Annotations[keys.DowngradedFrom]; ok {
+		initial := autoscalingv1.UpdateModeInitial
+		desired.Spec.UpdatePolicy.UpdateMode = &initial
+	}
+
+	off := autoscalingv1.ContainerScalingModeOff
+	excluded := annotations.List(current.Annotations[keys.ExcludedContainers])
+	if current.Spec.ResourcePolicy != nil {
+		_, inherited := current.Annotations[keys.InheritedFrom]
+		_, oomBumped := current.Annotations[keys.LastOOMBumpAt]
+		applied := appliedMinAllowed(current, keys)
+		for _, p := range current.Spec.ResourcePolicy.ContainerPolicies {
+			if slices.Contains(excluded, p.ContainerName) {
+				containerPolicy(desired, p.ContainerName).Mode = &off
+			}
+			var floors []corev1.ResourceName
+			switch {
+			case inherited:
+				floors = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+			case oomBumped:
+				floors = []corev1.ResourceName{corev1.ResourceMemory}
+			}
+			for _, name := range floors {
+				floor, ok := p.MinAllowed[name]
+				if !ok {
+					continue
+				}
+				if configured, ok := applied[p.ContainerName][name]; ok && floor.Cmp(configured) <= 0 {
+					continue
+				}
+				raiseMinAllowed(containerPolicy(desired, p.ContainerName), name, floor)
+			}
+		}
+	}
+	for _, name := range excluded {
+		containerPolicy(desired, name).Mode = &off
+	}
+}
+
+// appliedMinAllowed returns the minAllowed of the containers in the config
+// annotation the VPA was last applied with.
+func appliedMinAllowed(vpa *autoscalingv1.VerticalPodAutoscaler, keys annotations.Keys) map[string]corev1.ResourceList {
+	value, ok := vpa.Annotations[keys.Config]
+	if !ok {
+		return nil
+	}
+	wc, errs := annotations.ParseConfig(field.NewPath("metadata", "annotations").Key(keys.Config), value)
+	if len(errs) > 0 {
+		return nil
+	}
+	minAllowed := map[string]corev1.ResourceList{}
+	for _, c := range wc.Containers {
+		minAllowed[c.Name] = c.MinAllowed
+	}
+	return minAllowed
+}
+
+// raiseMinAllowed raises the minAllowed of a resource in the container policy to
+// the floor, capped by its maxAllowed.
+func raiseMinAllowed(policy *autoscalingv1.ContainerResourcePolicy, name corev1.ResourceName, floor resource.Quantity) {
+	if limit, ok := policy.MaxAllowed[name]; ok && floor.Cmp(limit) > 0 {
+		floor = limit
+	}
+	if current, ok := policy.MinAllowed[name]; ok && current.Cmp(floor) >= 0 {
+		return
+	}
+	if policy.MinAllowed == nil {
+		policy.MinAllowed = corev1.ResourceList{}
+	}
+	policy.MinAllowed[name] = floor.DeepCopy()
+}
+
+// normalizeResourcePolicy returns nil for a resource policy without container policies.
+func normalizeResourcePolicy(policy *autoscalingv1.PodResourcePolicy) *autoscalingv1.PodResourcePolicy {
+	if policy == nil || len(policy.ContainerPolicies) == 0 {
+		return nil
+	}
+	return policy
+}
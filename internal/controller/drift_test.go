@@ -0,0 +1,120 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func driftedDeployment(extra map[string]string) *appsv1.Deployment {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			UID:         "web-uid",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+	}
+	for k, v := range extra {
+		dep.Annotations[k] = v
+	}
+	return dep
+}
+
+func editedVPA(dep *appsv1.Deployment, mode autoscalingv1.UpdateMode) *autoscalingv1.VerticalPodAutoscaler {
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Spec = autoscalingv1.VerticalPodAutoscalerSpec{
+		TargetRef:    &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"},
+		UpdatePolicy: &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(mode)},
+		ResourcePolicy: &autoscalingv1.PodResourcePolicy{
+			ContainerPolicies: []autoscalingv1.ContainerResourcePolicy{{
+				ContainerName: "app",
+				MaxAllowed:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			}},
+		},
+	}
+	return vpa
+}
+
+func reconcileDrift(t *testing.T, dep *appsv1.Deployment, vpa *autoscalingv1.VerticalPodAutoscaler) (*controller.VPAControllerReconciler, *record.FakeRecorder, *autoscalingv1.VerticalPodAutoscaler) {
+	scheme := setupScheme(t)
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithInterceptorFuncs(applyAsMergePatch).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAControllerReconciler{
+		Client:       fakeClient,
+		Scheme:       scheme,
+		Metrics:      metrics.NewCollectors(),
+		Recorder:     recorder,
+		CorrectDrift: true,
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+	})
+	require.NoError(t, err)
+
+	var got autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &got))
+	return r, recorder, &got
+}
+
+func TestDrift_RevertsManualEdits(t *testing.T) {
+	dep := driftedDeployment(nil)
+	r, recorder, got := reconcileDrift(t, dep, editedVPA(dep, autoscalingv1.UpdateModeAuto))
+
+	assert.Equal(t, autoscalingv1.UpdateModeOff, *got.Spec.UpdatePolicy.UpdateMode)
+	assert.Nil(t, got.Spec.ResourcePolicy)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "DriftReverted")
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPADriftReverted.WithLabelValues("Deployment", "default", "updatePolicy")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPADriftReverted.WithLabelValues("Deployment", "default", "resourcePolicy")))
+}
+
+func TestDrift_KeepsIgnoredFields(t *testing.T) {
+	dep := driftedDeployment(map[string]string{"k8s.autoscaling.vpacreation/drift-ignore": "resourcePolicy"})
+	_, recorder, got := reconcileDrift(t, dep, editedVPA(dep, autoscalingv1.UpdateModeAuto))
+
+	assert.Equal(t, autoscalingv1.UpdateModeOff, *got.Spec.UpdatePolicy.UpdateMode)
+	require.NotNil(t, got.Spec.ResourcePolicy)
+	assert.Len(t, got.Spec.ResourcePolicy.ContainerPolicies, 1)
+	assert.Len(t, recorder.Events, 1)
+}
+
+func TestDrift_KeepsControllerAdjustments(t *testing.T) {
+	dep := driftedDeployment(map[string]string{"k8s.autoscaling.vpacreation/update-mode": "Auto"})
+	vpa := editedVPA(dep, autoscalingv1.UpdateModeInitial)
+	vpa.Annotations = map[string]string{
+		"k8s.autoscaling.vpacreation/downgraded-from":  "Auto",
+		"k8s.autoscaling.vpacreation/downgraded-at":    "2024-01-01T00:00:00Z",
+		"k8s.autoscaling.vpacreation/last-oom-bump-at": "2024-01-01T00:00:00Z",
+	}
+	vpa.Spec.ResourcePolicy.ContainerPolicies[0] = autoscalingv1.ContainerResourcePolicy{
+		ContainerName: "app",
+		MinAllowed:    corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+	}
+	_, recorder, got := reconcileDrift(t, dep, vpa)
+
+	assert.Equal(t, autoscalingv1.UpdateModeInitial, *got.Spec.UpdatePolicy.UpdateMode)
+	require.NotNil(t, got.Spec.ResourcePolicy)
+	assert.True(t, resource.MustParse("512Mi").Equal(got.Spec.ResourcePolicy.ContainerPolicies[0].MinAllowed[corev1.ResourceMemory]))
+	assert.Empty(t, recorder.Events)
+}
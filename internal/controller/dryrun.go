@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// dryRunClient reads through the wrapped client but never sends mutating calls:
+// each create, update, patch or delete is logged, counted and reported as an
+// event on the object instead.
+type dryRunClient struct {
+	client.Client
+	metrics  *metrics.Collectors
+	recorder record.EventRecorder
+}
+
+// NewDryRunClient wraps c so the reconcilers using it only report the changes
+// they would make.
+func NewDryRunClient(c client.Client, m *metrics.Collectors, recorder record.EventRecorder) client.Client {
+	return &dryRunClient{Client: c, metrics: m, recorder: recorder}
+}
+
+func (c *dryRunClient) Create(ctx context.Context, obj client.Object, _ ...client.CreateOption) error {
+	c.report(ctx, "create", obj)
+	return nil
+}
+
+func (c *dryRunClient) Update(ctx context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	c.report(ctx, "update", obj)
+	return nil
+}
+
+func (c *dryRunClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, _ ...client.PatchOption) error {
+	verb := "patch"
+	if patch == client.Apply {
+		verb = "apply"
+	}
+	c.report(ctx, verb, obj)
+	return nil
+}
+
+func (c *dryRunClient) Delete(ctx context.Context, obj client.Object, _ ...client.DeleteOption) error {
+	c.report(ctx, "delete", obj)
+	return nil
+}
+
+func (c *dryRunClient) DeleteAllOf(ctx context.Context, obj client.Object, _ ...client.DeleteAllOfOption) error {
+	c.report(ctx, "deletecollection", obj)
+	return nil
+}
+
+func (c *dryRunClient) report(ctx context.Context, verb string, obj client.Object) {
+	kind := kindOf(obj, c.Scheme())
+	log.FromContext(ctx).Info("Dry run, not sending request", "verb", verb, "kind", kind,
+		"namespace", obj.GetNamespace(), "name", obj.GetName())
+	c.metrics.DryRunActions.WithLabelValues(verb, kind, obj.GetNamespace()).Inc()
+	c.recorder.Event(obj, corev1.EventTypeNormal, "DryRun", fmt.Sprintf("Dry run: would %s %s %s", verb, kind, obj.GetName()))
+}
+
+// isDryRun reports whether the client only reports the changes it would make,
+// in which case the metrics counting created and deleted VPAs are left alone.
+func isDryRun(c client.Client) bool {
+	_, ok := c.(*dryRunClient)
+	return ok
+}
+
+func kindOf(obj runtime.Object, scheme *runtime.Scheme) string {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return "Unknown"
+	}
+	return gvk.Kind
+}
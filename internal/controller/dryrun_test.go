@@ -0,0 +1,77 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func TestDryRun_OnlyReportsChanges(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			UID:       "web-uid",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled":     "true",
+				"k8s.autoscaling.vpacreation/deletion-policy": "Retain",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+	orphaned := &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "orphaned-vpa", Namespace: "default"},
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, orphaned).Build()
+	collectors := metrics.NewCollectors()
+	recorder := record.NewFakeRecorder(10)
+	dryRunClient := controller.NewDryRunClient(fakeClient, collectors, recorder)
+	r := &controller.VPAControllerReconciler{
+		Client:   dryRunClient,
+		Scheme:   scheme,
+		Metrics:  collectors,
+		Recorder: recorder,
+	}
+	gc := &controller.GarbageCollector{Client: dryRunClient, Metrics: collectors}
+
+	require.NoError(t, gc.Collect(context.TODO()))
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+	})
+	require.NoError(t, err)
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	require.Len(t, vpas.Items, 1)
+	assert.Equal(t, "orphaned-vpa", vpas.Items[0].Name)
+
+	var got appsv1.Deployment
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(dep), &got))
+	assert.Empty(t, got.Finalizers)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(collectors.DryRunActions.WithLabelValues("delete", "VerticalPodAutoscaler", "default")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collectors.DryRunActions.WithLabelValues("patch", "Deployment", "default")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collectors.DryRunActions.WithLabelValues("apply", "VerticalPodAutoscaler", "default")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(collectors.VPACreated.WithLabelValues("Deployment", "default")), "no VPA is created")
+	assert.Equal(t, 0.0, testutil.ToFloat64(collectors.VPADeleted.WithLabelValues("default")), "no VPA is deleted")
+
+	require.Len(t, recorder.Events, 3)
+	assert.Equal(t, "Normal DryRun Dry run: would delete VerticalPodAutoscaler orphaned-vpa", <-recorder.Events)
+	assert.Equal(t, "Normal DryRun Dry run: would patch Deployment web", <-recorder.Events)
+	assert.Equal(t, "Normal DryRun Dry run: would apply VerticalPodAutoscaler web-vpa", <-recorder.Events)
+}
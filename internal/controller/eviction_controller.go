@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get
+
+// EvictionReason is the reason of the events emitted by the VPA updater when it evicts a pod.
+const EvictionReason = "EvictedByVPA"
+
+// UnknownWorkload is the workload the evictions of pods are counted under when
+// the pod is gone and its workload cannot be resolved.
+const UnknownWorkload = "unknown"
+
+// EvictionReconciler counts the pod evictions performed by the VPA updater per
+// workload, and downgrades the managed VPA of a workload evicted too often.
+type EvictionReconciler struct {
+	client.Client
+	// APIReader is used to resolve the owners of evicted pods without caching
+	// every pod and ReplicaSet of the cluster.
+	APIReader client.Reader
+	Metrics   *metrics.Collectors
+	Recorder  record.EventRecorder
+	// FlapThreshold is the number of evictions within FlapWindow after which the
+	// managed VPA of the workload is switched to Initial. Zero disables it.
+	FlapThreshold int
+	FlapWindow    time.Duration
+	// Namespaces restricts the namespaces the reconciler handles.
+	Namespaces NamespaceFilter
+	// Backoff bounds the retries of failed reconciles.
+	Backoff Backoff
+	// Config holds the configuration of the controller, reloaded on change.
+	// Defaults to config.Default().
+	Config *config.Store
+	// StartTime is when the controller started. The evictions before it were
+	// counted by the previous run of the controller, and are not counted again
+	// from the events listed on start. Defaults to when SetupWithManager is called.
+	StartTime time.Time
+
+	window evictionWindow
+
+	mu sync.Mutex
+	// seen holds the last count observed for each eviction event, as the
+	// event recorder aggregates repeated evictions into a single event.
+	seen map[types.UID]int32
+}
+
+func (r *EvictionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var ev corev1.Event
+	if err := r.Client.Get(ctx, req.NamespacedName, &ev); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get event", "name", req.NamespacedName)
+		return ctrl.Result{}, err
+	}
+
+	if !isEvictionEvent(&ev) {
+		return ctrl.Result{}, nil
+	}
+
+	delta := r.observe(&ev, time.Now())
+	if delta <= 0 {
+		return ctrl.Result{}, nil
+	}
+
+	podKey := client.ObjectKey{Namespace: ev.InvolvedObject.Namespace, Name: ev.InvolvedObject.Name}
+	workload, ok, gone, err := r.evictedWorkload(ctx, podKey)
+	if err != nil {
+		r.forget(&ev, delta)
+		return ctrl.Result{}, err
+	}
+	if !ok {
+		if !gone {
+			return ctrl.Result{}, nil
+		}
+		// The evictions of pods gone with their workload are still counted.
+		logger.Info("Evicted pod is already gone, cannot resolve its workload", "pod", podKey)
+		workload = workloadRef{Kind: "Unknown", Namespace: podKey.Namespace, Name: UnknownWorkload}
+	}
+
+	logger.Info("Pod evicted by VPA", "pod", podKey, "kind", workload.Kind, "workload", workload.Name)
+	r.Metrics.VPAEvictions.WithLabelValues(workload.Kind, workload.Namespace, workload.Name).Add(float64(delta))
+
+	if r.FlapThreshold > 0 && ok {
+		now := time.Now()
+		if n := r.window.add(workload, int(delta), evictionTime(&ev, now), now, r.FlapWindow); n >= r.FlapThreshold {
+			if err := r.protectFromFlapping(ctx, workload, n); err != nil {
+				logger.Error(err, "Failed to downgrade VPA update mode", "kind", workload.Kind, "workload", workload.Name)
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// evictedWorkload resolves the workload of the evicted pod. When the pod is
+// already gone, the workload is resolved from the name of the pod, and gone is
+// true. It returns false if the workload is not a supported one or cannot be
+// resolved.
+func (r *EvictionReconciler) evictedWorkload(ctx context.Context, podKey client.ObjectKey) (workloadRef, bool, bool, error) {
+	var pod corev1.Pod
+	if err := r.APIReader.Get(ctx, podKey, &pod); err != nil {
+		if !errors.IsNotFound(err) {
+			return workloadRef{}, false, false, err
+		}
+		workload, ok, err := workloadForPodName(ctx, r.APIReader, podKey.Namespace, podKey.Name)
+		return workload, ok, true, err
+	}
+	workload, ok, err := workloadForPod(ctx, r.APIReader, &pod)
+	return workload, ok, false, err
+}
+
+// protectFromFlapping downgrades the managed VPA of a workload evicted count
+// times within the flapping window.
+func (r *EvictionReconciler) protectFromFlapping(ctx context.Context, workload workloadRef, count int) error {
+	logger := log.FromContext(ctx)
+
+	obj, err := getWorkload(ctx, r.Client, workload.Kind, client.ObjectKey{Namespace: workload.Namespace, Name: workload.Name})
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	keys := currentKeys(r.Config)
+	vpa, ok, err := managedVPAFor(ctx, r.Client, obj, keys)
+	if err != nil || !ok {
+		return err
+	}
+
+	reason := fmt.Sprintf("%d evictions within %s", count, r.FlapWindow)
+	downgraded, err := downgradeUpdateMode(ctx, r.Client, r.Recorder, vpa, obj, reason, keys)
+	if err != nil {
+		return err
+	}
+	if downgraded {
+		logger.Info("Downgraded VPA update mode to stop eviction flapping", "name", vpa.Name, "reason", reason)
+		r.window.reset(workload)
+	}
+	return nil
+}
+
+// observe records the count of the event and returns the number of evictions
+// not accounted for yet. The evictions of an event seen for the first time are
+// not counted if they happened before StartTime. As the evictions aggregated in
+// an event are not dated one by one, an event that started before StartTime and
+// was updated since is counted as a single new eviction.
+func (r *EvictionReconciler) observe(ev *corev1.Event, now time.Time) int32 {
+	count := ev.Count
+	if count == 0 {
+		count = 1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen == nil {
+		r.seen = map[types.UID]int32{}
+	}
+	seen, ok := r.seen[ev.UID]
+	if !ok && !r.StartTime.IsZero() && firstEvictionTime(ev, now).Before(r.StartTime) {
+		seen = count - 1
+		if evictionTime(ev, now).Before(r.StartTime) {
+			seen = count
+		}
+		r.seen[ev.UID] = seen
+	}
+	delta := count - seen
+	if delta > 0 {
+		r.seen[ev.UID] = count
+	}
+	return delta
+}
+
+// forget rolls back an observation so the evictions are counted on retry.
+func (r *EvictionReconciler) forget(ev *corev1.Event, delta int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen[ev.UID] -= delta
+}
+
+// firstEvictionTime returns when the first eviction aggregated in the event
+// happened, falling back to now if the event carries no timestamp.
+func firstEvictionTime(ev *corev1.Event, now time.Time) time.Time {
+	switch {
+	case !ev.FirstTimestamp.IsZero():
+		return ev.FirstTimestamp.Time
+	case !ev.EventTime.IsZero():
+		return ev.EventTime.Time
+	case !ev.CreationTimestamp.IsZero():
+		return ev.CreationTimestamp.Time
+	default:
+		return now
+	}
+}
+
+func isEvictionEvent(o client.Object) bool {
+	ev, ok := o.(*corev1.Event)
+	return ok && ev.Reason == EvictionReason && ev.InvolvedObject.Kind == "Pod"
+}
+
+func (r *EvictionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.StartTime.IsZero() {
+		r.StartTime = time.Now()
+	}
+	isEviction := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool { return isEvictionEvent(e.Object) },
+		UpdateFunc: func(e event.UpdateEvent) bool { return isEvictionEvent(e.ObjectNew) },
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			if isEvictionEvent(e.Object) {
+				r.mu.Lock()
+				delete(r.seen, e.Object.GetUID())
+				r.mu.Unlock()
+			}
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool { return false },
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("vpauto-evictions").
+		WithEventFilter(r.Namespaces.Predicate()).
+		WithOptions(controller.Options{RateLimiter: r.Backoff.rateLimiter()}).
+		For(&corev1.Event{}, builder.WithPredicates(isEviction)).
+		Complete(r)
+}
@@ -0,0 +1,335 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func TestEviction_CountsPerWorkload(t *testing.T) {
+	scheme := setupScheme(t)
+
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "web-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f-abcde",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", UID: "rs-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	ev := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "web-5d8f-abcde.1", Namespace: "default", UID: "event-uid"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-5d8f-abcde"},
+		Reason:         controller.EvictionReason,
+		Count:          1,
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(rs, pod, ev).Build()
+	r := &controller.EvictionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Metrics:   metrics.NewCollectors(),
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-5d8f-abcde.1"}}
+
+	_, err := r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Deployment", "default", "web")))
+
+	// Reconciling the same event again must not count it twice.
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Deployment", "default", "web")))
+
+	// An aggregated event only adds the new evictions.
+	ev.Count = 3
+	require.NoError(t, fakeClient.Update(context.TODO(), ev))
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Deployment", "default", "web")))
+}
+
+func TestEviction_ResolvesWorkloadOfGonePod(t *testing.T) {
+	scheme := setupScheme(t)
+
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "web-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	evicted := func(uid, pod string) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: pod + ".1", Namespace: "default", UID: types.UID(uid)},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: pod},
+			Reason:         controller.EvictionReason,
+			Count:          1,
+		}
+	}
+
+	// Neither pod exists anymore, only the ReplicaSet of the first one does.
+	fakeClient := newClientBuilder(scheme).WithObjects(rs, evicted("web-uid", "web-5d8f-abcde"), evicted("db-uid", "db-0")).Build()
+	r := &controller.EvictionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Metrics:   metrics.NewCollectors(),
+	}
+
+	for _, name := range []string{"web-5d8f-abcde.1", "db-0.1"} {
+		_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Deployment", "default", "web")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Unknown", "default", controller.UnknownWorkload)))
+}
+
+func TestEviction_IgnoresOtherEvents(t *testing.T) {
+	scheme := setupScheme(t)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-0",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", UID: "db-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	ev := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "db-0.1", Namespace: "default", UID: "event-uid"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "db-0"},
+		Reason:         "Killing",
+		Count:          1,
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(pod, ev).Build()
+	r := &controller.EvictionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Metrics:   metrics.NewCollectors(),
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "db-0.1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, testutil.CollectAndCount(r.Metrics.VPAEvictions))
+}
+
+func TestEviction_DowngradesFlappingWorkload(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-abcde",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", UID: "rs-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "web-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeAuto)}
+	ev := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "web-abcde.1", Namespace: "default", UID: "event-uid"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-abcde"},
+		Reason:         controller.EvictionReason,
+		Count:          1,
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, pod, rs, vpa, ev).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.EvictionReconciler{
+		Client:        fakeClient,
+		APIReader:     fakeClient,
+		Metrics:       metrics.NewCollectors(),
+		Recorder:      recorder,
+		FlapThreshold: 3,
+		FlapWindow:    time.Hour,
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-abcde.1"}}
+
+	_, err := r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	var updated autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &updated))
+	assert.Equal(t, autoscalingv1.UpdateModeAuto, *updated.Spec.UpdatePolicy.UpdateMode, "below the threshold")
+
+	ev.Count = 3
+	require.NoError(t, fakeClient.Update(context.TODO(), ev))
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &updated))
+	assert.Equal(t, autoscalingv1.UpdateModeInitial, *updated.Spec.UpdatePolicy.UpdateMode)
+	assert.Equal(t, "Auto", updated.Annotations["k8s.autoscaling.vpacreation/downgraded-from"])
+	assert.Equal(t, "3 evictions within 1h0m0s", updated.Annotations["k8s.autoscaling.vpacreation/downgrade-reason"])
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning UpdateModeDowngraded")
+}
+
+func TestEviction_IgnoresEvictionsBeforeFlapWindow(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "web-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f-abcde",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", UID: "rs-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeAuto)}
+	// The evictions of an old event, listed again after a restart of the controller.
+	ev := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "web-5d8f-abcde.1", Namespace: "default", UID: "event-uid"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-5d8f-abcde"},
+		Reason:         controller.EvictionReason,
+		Count:          5,
+		FirstTimestamp: metav1.NewTime(time.Now().Add(-3 * time.Hour)),
+		LastTimestamp:  metav1.NewTime(time.Now().Add(-2 * time.Hour)),
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, rs, pod, vpa, ev).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.EvictionReconciler{
+		Client:        fakeClient,
+		APIReader:     fakeClient,
+		Metrics:       metrics.NewCollectors(),
+		Recorder:      recorder,
+		FlapThreshold: 3,
+		FlapWindow:    time.Hour,
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-5d8f-abcde.1"}}
+
+	_, err := r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Deployment", "default", "web")))
+
+	var updated autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &updated))
+	assert.Equal(t, autoscalingv1.UpdateModeAuto, *updated.Spec.UpdatePolicy.UpdateMode, "the evictions are older than the window")
+	assert.Empty(t, recorder.Events)
+
+	// Recent evictions of the event are counted in the window.
+	ev.Count = 8
+	ev.LastTimestamp = metav1.Now()
+	require.NoError(t, fakeClient.Update(context.TODO(), ev))
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &updated))
+	assert.Equal(t, autoscalingv1.UpdateModeInitial, *updated.Spec.UpdatePolicy.UpdateMode)
+}
+
+func TestEviction_SkipsEvictionsBeforeStart(t *testing.T) {
+	scheme := setupScheme(t)
+
+	start := time.Now().Add(-time.Minute)
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d8f",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "web-uid", Controller: ptr.To(true),
+			}},
+		},
+	}
+	evicted := func(pod string, count int32, first, last time.Time) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: pod + ".1", Namespace: "default", UID: types.UID(pod)},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: pod},
+			Reason:         controller.EvictionReason,
+			Count:          count,
+			FirstTimestamp: metav1.NewTime(first),
+			LastTimestamp:  metav1.NewTime(last),
+		}
+	}
+	// Retained from before the restart, counted by the previous run.
+	old := evicted("web-5d8f-aaaaa", 3, start.Add(-time.Hour), start.Add(-time.Hour))
+	// Started before the restart, and evicted again since.
+	ongoing := evicted("web-5d8f-bbbbb", 5, start.Add(-time.Hour), start.Add(time.Second))
+	// Started after the restart.
+	recent := evicted("web-5d8f-ccccc", 2, start.Add(time.Second), start.Add(2*time.Second))
+
+	fakeClient := newClientBuilder(scheme).WithObjects(rs, old, ongoing, recent).Build()
+	r := &controller.EvictionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Metrics:   metrics.NewCollectors(),
+		StartTime: start,
+	}
+	reconcileEvent := func(name string) {
+		_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+		require.NoError(t, err)
+	}
+	evictions := func() float64 {
+		return testutil.ToFloat64(r.Metrics.VPAEvictions.WithLabelValues("Deployment", "default", "web"))
+	}
+
+	reconcileEvent(old.Name)
+	assert.Equal(t, 0.0, evictions())
+	reconcileEvent(ongoing.Name)
+	assert.Equal(t, 1.0, evictions())
+	reconcileEvent(recent.Name)
+	assert.Equal(t, 3.0, evictions())
+
+	// New evictions aggregated in the retained event are counted.
+	old.Count = 4
+	old.LastTimestamp = metav1.NewTime(start.Add(3 * time.Second))
+	require.NoError(t, fakeClient.Update(context.TODO(), old))
+	reconcileEvent(old.Name)
+	assert.Equal(t, 4.0, evictions())
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// Policies applied when an opted-in workload is already targeted by a VPA the
+// controller did not create.
+const (
+	// ExistingVPASkip leaves the existing VPA alone and does not create one.
+	ExistingVPASkip = "Skip"
+	// ExistingVPAAdopt makes the workload the owner of the existing VPA, so it is
+	// deleted with the workload, and does not create one.
+	ExistingVPAAdopt = "Adopt"
+	// ExistingVPAReplace deletes the existing VPA and creates the managed one.
+	ExistingVPAReplace = "Replace"
+)
+
+// ExistingVPAPolicies are the accepted values of VPAControllerReconciler.ExistingVPAPolicy.
+var ExistingVPAPolicies = []string{ExistingVPASkip, ExistingVPAAdopt, ExistingVPAReplace}
+
+// existingVPAs returns the VPAs that target the workload and are not controlled
+// by it, sorted by name. It also reports whether the workload controls a VPA it
+// adopted. VPAs created by earlier versions of the controller, before they were
+// labelled, are labelled as managed instead, unless they were adopted.
+func (r *VPAControllerReconciler) existingVPAs(ctx context.Context, obj client.Object) ([]autoscalingv1.VerticalPodAutoscaler, bool, error) {
+	vpas, err := vpasTargeting(ctx, r.Client, obj.GetNamespace(), getKind(obj), obj.GetName())
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys := currentKeys(r.Config)
+	var existing []autoscalingv1.VerticalPodAutoscaler
+	adopted := false
+	for _, vpa := range vpas {
+		if !targets(&vpa, obj) {
+			continue
+		}
+		switch {
+		case !metav1.IsControlledBy(&vpa, obj):
+			existing = append(existing, vpa)
+		case isManagedVPA(&vpa, keys):
+		case vpa.Annotations[keys.Adopted] == "true":
+			adopted = true
+		case r.isUnlabelledVPA(&vpa, obj):
+			if err := labelManaged(ctx, r.Client, &vpa, keys); err != nil {
+				return nil, false, err
+			}
+			log.FromContext(ctx).Info("Labelled VPA created by an earlier version of the controller as managed", "name", vpa.Name)
+		default:
+			adopted = true
+		}
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].Name < existing[j].Name })
+	return existing, adopted, nil
+}
+
+// isUnlabelledVPA reports whether a VPA controlled by the workload was created by
+// an earlier version of the controller, which did not label its VPAs: it has the
+// name the controller gives to the VPA of the workload, and no managed-by label.
+func (r *VPAControllerReconciler) isUnlabelledVPA(vpa *autoscalingv1.VerticalPodAutoscaler, obj client.Object) bool {
+	_, labelled := vpa.Labels[annotations.ManagedBy]
+	return !labelled && vpa.Name == r.vpaNames(obj)[0]
+}
+
+// labelManaged labels the VPA as managed by the instance of the controller using the keys.
+func labelManaged(ctx context.Context, c client.Client, vpa *autoscalingv1.VerticalPodAutoscaler, keys annotations.Keys) error {
+	patch := client.MergeFrom(vpa.DeepCopy())
+	metav1.SetMetaDataLabel(&vpa.ObjectMeta, annotations.ManagedBy, keys.ManagedByValue)
+	return patchVPA(ctx, c, vpa, patch, keys)
+}
+
+// handleExistingVPAs applies the existing VPA policy to the VPAs already
+// targeting the workload. It returns true if the managed VPA must not be created.
+func (r *VPAControllerReconciler) handleExistingVPAs(ctx context.Context, obj client.Object, existing []autoscalingv1.VerticalPodAutoscaler) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	names := make([]string, 0, len(existing))
+	for _, vpa := range existing {
+		names = append(names, vpa.Name)
+	}
+	kind := getKind(obj)
+
+	switch r.ExistingVPAPolicy {
+	case ExistingVPAAdopt:
+		vpa := &existing[0]
+		patch := client.MergeFrom(vpa.DeepCopy())
+		if err := ctrl.SetControllerReference(obj, vpa, r.Scheme); err != nil {
+			logger.Info("Cannot adopt existing VPA, it is controlled by another object", "name", vpa.Name)
+			r.Recorder.Event(obj, corev1.EventTypeWarning, "ExistingVPANotAdopted",
+				fmt.Sprintf("VPA %s already targets %s %s but cannot be adopted: %v", vpa.Name, kind, obj.GetName(), err))
+			return true, nil
+		}
+		keys := currentKeys(r.Config)
+		metav1.SetMetaDataAnnotation(&vpa.ObjectMeta, keys.Adopted, "true")
+		if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+			return false, err
+		}
+		logger.Info("Adopted existing VPA", "name", vpa.Name)
+		r.Recorder.Event(obj, corev1.EventTypeNormal, "ExistingVPAAdopted",
+			fmt.Sprintf("VPA %s already targets %s %s, adopted it instead of creating one", vpa.Name, kind, obj.GetName()))
+		return true, nil
+
+	case ExistingVPAReplace:
+		for i := range existing {
+			if err := r.Client.Delete(ctx, &existing[i]); client.IgnoreNotFound(err) != nil {
+				return false, err
+			}
+			logger.Info("Deleted existing VPA to replace it", "name", existing[i].Name)
+			if !isDryRun(r.Client) {
+				r.Metrics.VPADeleted.WithLabelValues(existing[i].Namespace).Inc()
+			}
+		}
+		r.Recorder.Event(obj, corev1.EventTypeNormal, "ExistingVPAReplaced",
+			fmt.Sprintf("VPA %s already targeted %s %s, replaced by the managed VPA", strings.Join(names, ", "), kind, obj.GetName()))
+		return false, nil
+
+	default:
+		logger.Info("Workload is already targeted by a VPA, not creating one", "vpas", names)
+		r.Recorder.Event(obj, corev1.EventTypeNormal, "ExistingVPASkipped",
+			fmt.Sprintf("VPA %s already targets %s %s, not creating one", strings.Join(names, ", "), kind, obj.GetName()))
+		return true, nil
+	}
+}
+
+// targets reports whether the VPA targets the workload.
+func targets(vpa *autoscalingv1.VerticalPodAutoscaler, obj client.Object) bool {
+	ref := vpa.Spec.TargetRef
+	if ref == nil || ref.Kind != getKind(obj) || ref.Name != obj.GetName() {
+		return false
+	}
+	return ref.APIVersion == "" || strings.HasPrefix(ref.APIVersion, "apps/")
+}
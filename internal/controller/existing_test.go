@@ -0,0 +1,146 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func TestReconcile_ExistingVPAPolicies(t *testing.T) {
+	tests := []struct {
+		policy    string
+		existing  string
+		event     string
+		wantVPAs  []string
+		wantOwned bool
+	}{
+		{policy: controller.ExistingVPASkip, existing: "handwritten", event: "ExistingVPASkipped", wantVPAs: []string{"handwritten"}},
+		// The existing VPA has the name the controller gives to the VPA of the
+		// workload, so once adopted it looks like the VPA of an earlier version.
+		{policy: controller.ExistingVPAAdopt, existing: "web-vpa", event: "ExistingVPAAdopted", wantVPAs: []string{"web-vpa"}, wantOwned: true},
+		{policy: controller.ExistingVPAReplace, existing: "handwritten", event: "ExistingVPAReplaced", wantVPAs: []string{"web-vpa"}, wantOwned: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			scheme := setupScheme(t)
+
+			dep := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "web",
+					Namespace:   "default",
+					UID:         "web-uid",
+					Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+				},
+				Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+			}
+			handwritten := &autoscalingv1.VerticalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: tt.existing, Namespace: "default"},
+				Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+					TargetRef: &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"},
+				},
+			}
+
+			fakeClient := newClientBuilder(scheme).WithObjects(dep, handwritten).
+				WithInterceptorFuncs(applyAsMergePatch).Build()
+			recorder := record.NewFakeRecorder(10)
+			r := &controller.VPAControllerReconciler{
+				Client:            fakeClient,
+				Scheme:            scheme,
+				Metrics:           metrics.NewCollectors(),
+				Recorder:          recorder,
+				ExistingVPAPolicy: tt.policy,
+			}
+
+			_, err := r.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+			})
+			require.NoError(t, err)
+
+			var vpas autoscalingv1.VerticalPodAutoscalerList
+			require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+			var names []string
+			for _, vpa := range vpas.Items {
+				names = append(names, vpa.Name)
+			}
+			assert.Equal(t, tt.wantVPAs, names)
+			assert.Equal(t, tt.wantOwned, metav1.IsControlledBy(&vpas.Items[0], dep))
+
+			require.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, tt.event)
+
+			// Reconciling again must not create a second VPA nor touch the first one.
+			_, err = r.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+			})
+			require.NoError(t, err)
+			require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+			require.Len(t, vpas.Items, 1)
+			if tt.policy == controller.ExistingVPAAdopt {
+				assert.Equal(t, "true", vpas.Items[0].Annotations["k8s.autoscaling.vpacreation/adopted"])
+				assert.NotContains(t, vpas.Items[0].Labels, "app.kubernetes.io/managed-by", "the adopted VPA is not managed")
+			}
+		})
+	}
+}
+
+func TestReconcile_LabelsVPAOfEarlierVersion(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			UID:       "web-uid",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+				"k8s.autoscaling.vpacreation/update-mode": "Auto",
+			},
+		},
+	}
+	// The VPAs of earlier versions are owned by their workload, without label.
+	off := autoscalingv1.UpdateModeOff
+	earlier := &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-vpa",
+			Namespace:       "default",
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(dep, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+		},
+		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+			TargetRef:    &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"},
+			UpdatePolicy: &autoscalingv1.PodUpdatePolicy{UpdateMode: &off},
+		},
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, earlier).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	require.Len(t, vpas.Items, 1)
+	vpa := vpas.Items[0]
+	assert.Equal(t, "web-vpa", vpa.Name)
+	assert.Equal(t, "vpauto-creation-controller", vpa.Labels["app.kubernetes.io/managed-by"])
+	assert.Equal(t, autoscalingv1.UpdateModeAuto, *vpa.Spec.UpdatePolicy.UpdateMode, "the VPA is managed again")
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+)
+
+// evictionWindow keeps the recent evictions of each workload.
+type evictionWindow struct {
+	mu        sync.Mutex
+	evictions map[workloadRef][]time.Time
+}
+
+// add records count evictions of the workload observed at the given time, and
+// returns the number of evictions within the window ending now. Evictions
+// observed before the window, such as the ones of old events listed again on
+// restart, are dropped.
+func (w *evictionWindow) add(workload workloadRef, count int, observed, now time.Time, window time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.evictions == nil {
+		w.evictions = map[workloadRef][]time.Time{}
+	}
+
+	var recent []time.Time
+	for _, t := range w.evictions[workload] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	if now.Sub(observed) < window {
+		for i := 0; i < count; i++ {
+			recent = append(recent, observed)
+		}
+	}
+	if len(recent) == 0 {
+		delete(w.evictions, workload)
+		return 0
+	}
+	w.evictions[workload] = recent
+	return len(recent)
+}
+
+// evictionTime returns when the last eviction of the event was observed: the
+// last observation of its series, else its last timestamp, else its event time,
+// first timestamp or creation. It falls back to now for events without any time.
+func evictionTime(ev *corev1.Event, now time.Time) time.Time {
+	switch {
+	case ev.Series != nil && !ev.Series.LastObservedTime.IsZero():
+		return ev.Series.LastObservedTime.Time
+	case !ev.LastTimestamp.IsZero():
+		return ev.LastTimestamp.Time
+	case !ev.EventTime.IsZero():
+		return ev.EventTime.Time
+	case !ev.FirstTimestamp.IsZero():
+		return ev.FirstTimestamp.Time
+	case !ev.CreationTimestamp.IsZero():
+		return ev.CreationTimestamp.Time
+	default:
+		return now
+	}
+}
+
+func (w *evictionWindow) reset(workload workloadRef) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.evictions, workload)
+}
+
+// downgradeUpdateMode switches the VPA to Initial so the updater stops evicting
+// pods, and records why on the VPA, in the downgrade annotations of the keys, and
+// on the workload. It returns false if the VPA was not evicting pods in the first
+// place.
+func downgradeUpdateMode(ctx context.Context, c client.Client, recorder record.EventRecorder,
+	vpa *autoscalingv1.VerticalPodAutoscaler, workload client.Object, reason string, keys annotations.Keys) (bool, error) {
+	if vpa.Spec.UpdatePolicy == nil || vpa.Spec.UpdatePolicy.UpdateMode == nil {
+		return false, nil
+	}
+	mode := *vpa.Spec.UpdatePolicy.UpdateMode
+	if mode != autoscalingv1.UpdateModeRecreate && mode != autoscalingv1.UpdateModeAuto {
+		return false, nil
+	}
+
+	patch := client.MergeFrom(vpa.DeepCopy())
+	initial := autoscalingv1.UpdateModeInitial
+	vpa.Spec.UpdatePolicy.UpdateMode = &initial
+	if vpa.Annotations == nil {
+		vpa.Annotations = map[string]string{}
+	}
+	vpa.Annotations[keys.DowngradedFrom] = string(mode)
+	vpa.Annotations[keys.DowngradedAt] = time.Now().UTC().Format(time.RFC3339)
+	vpa.Annotations[keys.DowngradeReason] = reason
+	if err := patchVPA(ctx, c, vpa, patch, keys); err != nil {
+		return false, err
+	}
+
+	recorder.Event(workload, corev1.EventTypeWarning, "UpdateModeDowngraded",
+		fmt.Sprintf("VPA %s switched from %s to Initial: %s", vpa.Name, mode, reason))
+	return true, nil
+}
+
+// restoreUpdateMode puts back the update mode of a downgraded VPA once the
+// cool-down has elapsed or a manual reset was requested with the reset-downgrade
+// annotation. The mode restored is the one the workload currently asks for, which
+// may have changed since the downgrade, or the mode downgraded from if the
+// workload is not found. It returns how long to wait before the cool-down
+// elapses, or zero if there is nothing to wait for.
+func restoreUpdateMode(ctx context.Context, c client.Client, recorder record.EventRecorder,
+	vpa *autoscalingv1.VerticalPodAutoscaler, workload client.Object, cooldown time.Duration, cfg *config.Configuration) (time.Duration, error) {
+	keys := cfg.Keys()
+	from, ok := vpa.Annotations[keys.DowngradedFrom]
+	if !ok {
+		return 0, nil
+	}
+
+	if vpa.Annotations[keys.ResetDowngrade] != "true" {
+		if cooldown <= 0 {
+			return 0, nil
+		}
+		downgradedAt, err := time.Parse(time.RFC3339, vpa.Annotations[keys.DowngradedAt])
+		if err == nil {
+			if wait := cooldown - time.Since(downgradedAt); wait > 0 {
+				return wait, nil
+			}
+		}
+	}
+
+	patch := client.MergeFrom(vpa.DeepCopy())
+	mode := autoscalingv1.UpdateMode(from)
+	if workload != nil {
+		wc, _ := workloadConfig(workload, keys)
+		mode = updateModeFor(workload, wc, cfg)
+	}
+	if vpa.Spec.UpdatePolicy == nil {
+		vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{}
+	}
+	vpa.Spec.UpdatePolicy.UpdateMode = &mode
+	delete(vpa.Annotations, keys.DowngradedFrom)
+	delete(vpa.Annotations, keys.DowngradedAt)
+	delete(vpa.Annotations, keys.DowngradeReason)
+	delete(vpa.Annotations, keys.ResetDowngrade)
+	if err := patchVPA(ctx, c, vpa, patch, keys); err != nil {
+		return 0, err
+	}
+
+	if workload != nil {
+		recorder.Event(workload, corev1.EventTypeNormal, "UpdateModeRestored",
+			fmt.Sprintf("VPA %s switched back to %s", vpa.Name, mode))
+	}
+	return 0, nil
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// DefaultGCInterval is the time between two cleanups of the orphaned VPAs when
+// the configuration sets no GC interval.
+const DefaultGCInterval = time.Minute
+
+// GarbageCollector periodically deletes the orphaned VPAs: the VPAs created by
+// the controller that lost their workload, once their retention TTL has
+// elapsed, and the VPAs without owner nor target. VPAs written by hand for a
+// workload are left alone. It runs on the leader only, independently of the
+// reconciles of the workloads.
+type GarbageCollector struct {
+	Client  client.Client
+	Metrics *metrics.Collectors
+	// RetainTTL is how long a VPA is retained after the deletion of its workload
+	// before it is garbage collected. Zero retains it forever.
+	RetainTTL time.Duration
+	// Namespaces restricts the namespaces cleaned up.
+	Namespaces NamespaceFilter
+	// Config holds the configuration of the controller, reloaded on change.
+	// Defaults to config.Default().
+	Config *config.Store
+}
+
+// Start cleans up the orphaned VPAs every GC interval until the context is done.
+func (g *GarbageCollector) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("vpa-gc")
+	for {
+		if err := g.Collect(ctx); err != nil {
+			logger.Error(err, "Failed to clean up orphaned VPAs")
+		}
+		interval := currentConfig(g.Config).GCInterval.Duration
+		if interval <= 0 {
+			interval = DefaultGCInterval
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// NeedLeaderElection runs the garbage collector on the leader only.
+func (g *GarbageCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// Collect deletes the orphaned VPAs once.
+func (g *GarbageCollector) Collect(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	if err := g.Client.List(ctx, &vpas); err != nil {
+		return err
+	}
+	keys := currentKeys(g.Config)
+	now := time.Now()
+	for i := range vpas.Items {
+		vpa := &vpas.Items[i]
+		if !g.Namespaces.Allows(vpa.Namespace) || len(vpa.OwnerReferences) > 0 {
+			continue
+		}
+		if (isManagedVPA(vpa, keys) || vpa.Spec.TargetRef == nil) && g.retentionExpired(vpa, now) {
+			logger.Info("Deleting orphaned VPA", "namespace", vpa.Namespace, "name", vpa.Name)
+			if err := g.Client.Delete(ctx, vpa); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			if !isDryRun(g.Client) {
+				g.Metrics.VPADeleted.WithLabelValues(vpa.Namespace).Inc()
+			}
+		}
+	}
+	return nil
+}
+
+// retentionExpired reports whether a VPA retained after the deletion of its
+// workload may be garbage collected. VPAs that are not retained are always expired.
+func (g *GarbageCollector) retentionExpired(vpa *autoscalingv1.VerticalPodAutoscaler, now time.Time) bool {
+	v, ok := vpa.Annotations[currentKeys(g.Config).RetainedAt]
+	if !ok {
+		return true
+	}
+	retainedAt, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return true
+	}
+	return g.RetainTTL > 0 && now.Sub(retainedAt) >= g.RetainTTL
+}
@@ -0,0 +1,80 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func TestGarbageCollector_DeletesOrphanedVPAs(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := func(name string, labelled bool, owned bool, target bool) *autoscalingv1.VerticalPodAutoscaler {
+		v := &autoscalingv1.VerticalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		if labelled {
+			v.Labels = map[string]string{"app.kubernetes.io/managed-by": "vpauto-creation-controller"}
+		}
+		if owned {
+			v.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(dep, appsv1.SchemeGroupVersion.WithKind("Deployment"))}
+		}
+		if target {
+			v.Spec.TargetRef = &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"}
+		}
+		return v
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(
+		vpa("orphaned", true, false, true),
+		vpa("without-target", false, false, false),
+		vpa("handwritten", false, false, true),
+		vpa("owned", true, true, true),
+	).Build()
+	gc := &controller.GarbageCollector{Client: fakeClient, Metrics: metrics.NewCollectors()}
+
+	require.NoError(t, gc.Collect(context.TODO()))
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	var names []string
+	for _, v := range vpas.Items {
+		names = append(names, v.Name)
+	}
+	assert.ElementsMatch(t, []string{"handwritten", "owned"}, names)
+}
+
+func TestGarbageCollector_RunsPeriodically(t *testing.T) {
+	scheme := setupScheme(t)
+
+	cfg := config.Default()
+	cfg.GCInterval = metav1.Duration{Duration: 10 * time.Millisecond}
+	fakeClient := newClientBuilder(scheme).Build()
+	gc := &controller.GarbageCollector{Client: fakeClient, Metrics: metrics.NewCollectors(), Config: config.NewStore(cfg)}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() { done <- gc.Start(ctx) }()
+
+	// A VPA orphaned while no workload changes is still cleaned up.
+	orphaned := &autoscalingv1.VerticalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: "orphaned", Namespace: "default"}}
+	require.NoError(t, fakeClient.Create(context.TODO(), orphaned))
+	assert.Eventually(t, func() bool {
+		return errors.IsNotFound(fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(orphaned), orphaned))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"context"
+
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// VPATargetRefIndex is the field index of the VPAs by the kind and name of their
+// target, in the <kind>/<name> form.
+const VPATargetRefIndex = "spec.targetRef"
+
+// IndexVPATargetRef extracts the VPATargetRefIndex value of a VPA.
+func IndexVPATargetRef(o client.Object) []string {
+	vpa, ok := o.(*autoscalingv1.VerticalPodAutoscaler)
+	if !ok || vpa.Spec.TargetRef == nil {
+		return nil
+	}
+	return []string{targetRefKey(vpa.Spec.TargetRef.Kind, vpa.Spec.TargetRef.Name)}
+}
+
+// SetupIndexes registers the field indexes used by the reconcilers.
+func SetupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	return indexer.IndexField(ctx, &autoscalingv1.VerticalPodAutoscaler{}, VPATargetRefIndex, IndexVPATargetRef)
+}
+
+func targetRefKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+// vpasTargeting returns the VPAs of the namespace whose target has the given kind
+// and name, whatever their name.
+func vpasTargeting(ctx context.Context, c client.Reader, namespace, kind, name string) ([]autoscalingv1.VerticalPodAutoscaler, error) {
+	var list autoscalingv1.VerticalPodAutoscalerList
+	if err := c.List(ctx, &list, client.InNamespace(namespace), client.MatchingFields{VPATargetRefIndex: targetRefKey(kind, name)}); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// inheritRecommendation seeds the minAllowed of the containers of a new VPA
+// with the last recommendation of the VPA of the workload named in the
+// inherit-from annotation, so a renamed or redeployed workload does not start
+// from scratch. The inherited-from annotation of the VPA records its source.
+// Until then, the inheritance is pending and retried on every reconcile, until
+// the VPA gives a recommendation of its own. The missing source is only warned
+// about when the VPA is created.
+func (r *VPAControllerReconciler) inheritRecommendation(ctx context.Context, obj client.Object, vpa *autoscalingv1.VerticalPodAutoscaler, created bool) error {
+	logger := log.FromContext(ctx)
+
+	keys := currentKeys(r.Config)
+	from, ok := obj.GetAnnotations()[keys.InheritFrom]
+	if !ok || from == "" {
+		return nil
+	}
+	if _, inherited := vpa.Annotations[keys.InheritedFrom]; inherited || hasRecommendation(vpa) {
+		return nil
+	}
+
+	source, err := r.inheritSource(ctx, obj.GetNamespace(), from)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		logger.Info("No recommendation to inherit", "name", vpa.Name, "from", from)
+		if created {
+			r.Recorder.Event(obj, corev1.EventTypeWarning, "InheritSourceNotFound",
+				fmt.Sprintf("No VPA with a recommendation targets %s, VPA %s starts from scratch", from, vpa.Name))
+		}
+		return nil
+	}
+
+	patch := client.MergeFrom(vpa.DeepCopy())
+	for _, rec := range source.Status.Recommendation.ContainerRecommendations {
+		minAllowed := corev1.ResourceList{}
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if q, ok := rec.Target[name]; ok {
+				minAllowed[name] = q.DeepCopy()
+			}
+		}
+		if len(minAllowed) > 0 {
+			containerPolicy(vpa, rec.ContainerName).MinAllowed = minAllowed
+		}
+	}
+	if vpa.Annotations == nil {
+		vpa.Annotations = map[string]string{}
+	}
+	vpa.Annotations[keys.InheritedFrom] = source.Name
+	if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+		return err
+	}
+
+	logger.Info("Inherited recommendation", "name", vpa.Name, "from", source.Name)
+	r.Recorder.Event(obj, corev1.EventTypeNormal, "RecommendationInherited",
+		fmt.Sprintf("Seeded minAllowed of VPA %s from the recommendation of VPA %s", vpa.Name, source.Name))
+	return nil
+}
+
+// inheritSource returns the VPA with a recommendation targeting the named
+// workload of the namespace, or nil if there is none.
+func (r *VPAControllerReconciler) inheritSource(ctx context.Context, namespace, workload string) (*autoscalingv1.VerticalPodAutoscaler, error) {
+	for _, kind := range workloadKinds {
+		vpas, err := vpasTargeting(ctx, r.Client, namespace, kind, workload)
+		if err != nil {
+			return nil, err
+		}
+		for i := range vpas {
+			if hasRecommendation(&vpas[i]) {
+				return &vpas[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
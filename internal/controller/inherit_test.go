@@ -0,0 +1,153 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func reconcileInheriting(t *testing.T, objs ...client.Object) (*record.FakeRecorder, *autoscalingv1.VerticalPodAutoscaler) {
+	scheme := setupScheme(t)
+
+	green := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "checkout-green",
+			Namespace: "default",
+			UID:       "green-uid",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled":  "true",
+				"k8s.autoscaling.vpacreation/inherit-from": "checkout-blue",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "checkout"}}},
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(append(objs, green)...).
+		WithInterceptorFuncs(applyAsMergePatch).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: recorder,
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "checkout-green"},
+	})
+	require.NoError(t, err)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "checkout-green-vpa"}, &vpa))
+	return recorder, &vpa
+}
+
+// inheritSourceVPA returns the VPA of the checkout-blue Deployment, with a recommendation.
+func inheritSourceVPA(blue *appsv1.Deployment) *autoscalingv1.VerticalPodAutoscaler {
+	blueVPA := managedVPA("checkout-blue-vpa", blue)
+	blueVPA.Spec.TargetRef = &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "checkout-blue", APIVersion: "apps/v1"}
+	blueVPA.Status.Recommendation = &autoscalingv1.RecommendedPodResources{
+		ContainerRecommendations: []autoscalingv1.RecommendedContainerResources{{
+			ContainerName: "app",
+			Target: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("250m"),
+				corev1.ResourceMemory: resource.MustParse("300Mi"),
+			},
+		}},
+	}
+	return blueVPA
+}
+
+func TestInherit_SeedsMinAllowedFromRecommendation(t *testing.T) {
+	blue := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "checkout-blue", Namespace: "default", UID: "blue-uid"}}
+	recorder, vpa := reconcileInheriting(t, blue, inheritSourceVPA(blue))
+
+	assert.Equal(t, "checkout-blue-vpa", vpa.Annotations["k8s.autoscaling.vpacreation/inherited-from"])
+	require.NotNil(t, vpa.Spec.ResourcePolicy)
+	require.Len(t, vpa.Spec.ResourcePolicy.ContainerPolicies, 1)
+	policy := vpa.Spec.ResourcePolicy.ContainerPolicies[0]
+	assert.Equal(t, "app", policy.ContainerName)
+	assert.True(t, resource.MustParse("250m").Equal(policy.MinAllowed[corev1.ResourceCPU]))
+	assert.True(t, resource.MustParse("300Mi").Equal(policy.MinAllowed[corev1.ResourceMemory]))
+	assert.Equal(t, "checkout-green", vpa.Spec.TargetRef.Name)
+
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "RecommendationInherited")
+}
+
+func TestInherit_ReportsMissingSource(t *testing.T) {
+	recorder, vpa := reconcileInheriting(t)
+
+	assert.Nil(t, vpa.Spec.ResourcePolicy)
+	assert.NotContains(t, vpa.Annotations, "k8s.autoscaling.vpacreation/inherited-from")
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "InheritSourceNotFound")
+}
+
+func TestInherit_RetriesPendingInheritance(t *testing.T) {
+	scheme := setupScheme(t)
+
+	blue := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "checkout-blue", Namespace: "default", UID: "blue-uid"}}
+	green := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "checkout-green",
+			Namespace: "default",
+			UID:       "green-uid",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled":  "true",
+				"k8s.autoscaling.vpacreation/inherit-from": "checkout-blue",
+			},
+		},
+	}
+
+	// The VPA is created, but seeding its minAllowed fails once.
+	failed := false
+	funcs := interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if patch.Type() == types.MergePatchType && !failed {
+				failed = true
+				return errors.New("connection reset")
+			}
+			return applyAsMergePatch.Patch(ctx, c, obj, patch, opts...)
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(blue, inheritSourceVPA(blue), green).WithInterceptorFuncs(funcs).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "checkout-green"}}
+
+	_, err := r.Reconcile(context.TODO(), req)
+	require.Error(t, err)
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "checkout-green-vpa"}, &vpa))
+	assert.NotContains(t, vpa.Annotations, "k8s.autoscaling.vpacreation/inherited-from")
+
+	// The inheritance is pending on the existing VPA and retried.
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "checkout-green-vpa"}, &vpa))
+	assert.Equal(t, "checkout-blue-vpa", vpa.Annotations["k8s.autoscaling.vpacreation/inherited-from"])
+	require.NotNil(t, vpa.Spec.ResourcePolicy)
+	assert.True(t, resource.MustParse("300Mi").Equal(vpa.Spec.ResourcePolicy.ContainerPolicies[0].MinAllowed[corev1.ResourceMemory]))
+}
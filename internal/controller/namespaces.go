@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"slices"
+
+	"k8s.io/apimachinery/pkg/fields"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// DefaultExcludedNamespaces are the system namespaces the controller leaves alone by default.
+var DefaultExcludedNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// NamespaceFilter restricts the namespaces the controller watches and reconciles.
+// The zero value allows every namespace.
+type NamespaceFilter struct {
+	// Watch lists the namespaces to watch. Empty watches every namespace.
+	Watch []string
+	// Exclude lists namespaces never to watch, even if they are in Watch.
+	Exclude []string
+	// Shard restricts the namespaces reconciled to the ones assigned to the shard
+	// of the replica. It does not restrict the cache.
+	Shard Shard
+}
+
+// Allows reports whether objects of the namespace are reconciled. Cluster-scoped
+// objects are always allowed.
+func (f NamespaceFilter) Allows(namespace string) bool {
+	if namespace == "" {
+		return true
+	}
+	return f.watches(namespace) && f.Shard.Owns(namespace)
+}
+
+// watches reports whether objects of the namespace are watched, whatever the shard.
+func (f NamespaceFilter) watches(namespace string) bool {
+	if slices.Contains(f.Exclude, namespace) {
+		return false
+	}
+	return len(f.Watch) == 0 || slices.Contains(f.Watch, namespace)
+}
+
+// Predicate filters out the events of the objects of namespaces that are not allowed.
+func (f NamespaceFilter) Predicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return f.Allows(o.GetNamespace())
+	})
+}
+
+// CacheNamespaces returns the namespace configs of the manager cache, so objects
+// of namespaces that are not watched are not cached at all. The field selector, if
+// not nil, is added to every config as the namespace configs take precedence over
+// the field selector of a ByObject. It returns nil when every namespace is watched.
+func (f NamespaceFilter) CacheNamespaces(selector fields.Selector) map[string]cache.Config {
+	if len(f.Watch) > 0 {
+		namespaces := map[string]cache.Config{}
+		for _, ns := range f.Watch {
+			if f.watches(ns) {
+				namespaces[ns] = cache.Config{FieldSelector: selector}
+			}
+		}
+		return namespaces
+	}
+	if len(f.Exclude) == 0 {
+		return nil
+	}
+
+	var selectors []fields.Selector
+	if selector != nil {
+		selectors = append(selectors, selector)
+	}
+	for _, ns := range f.Exclude {
+		selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+	}
+	return map[string]cache.Config{
+		cache.AllNamespaces: {FieldSelector: fields.AndSelectors(selectors...)},
+	}
+}
@@ -0,0 +1,49 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/fields"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+)
+
+func TestNamespaceFilter_Allows(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    controller.NamespaceFilter
+		namespace string
+		want      bool
+	}{
+		{name: "zero value allows everything", namespace: "kube-system", want: true},
+		{name: "excluded", filter: controller.NamespaceFilter{Exclude: []string{"kube-system"}}, namespace: "kube-system"},
+		{name: "not excluded", filter: controller.NamespaceFilter{Exclude: []string{"kube-system"}}, namespace: "shop", want: true},
+		{name: "watched", filter: controller.NamespaceFilter{Watch: []string{"shop"}}, namespace: "shop", want: true},
+		{name: "not watched", filter: controller.NamespaceFilter{Watch: []string{"shop"}}, namespace: "payments"},
+		{name: "watched but excluded", filter: controller.NamespaceFilter{Watch: []string{"shop"}, Exclude: []string{"shop"}}, namespace: "shop"},
+		{name: "cluster-scoped", filter: controller.NamespaceFilter{Watch: []string{"shop"}}, namespace: "", want: true},
+		{name: "other shard", filter: controller.NamespaceFilter{Shard: controller.Shard{ID: 1, Count: 2}}, namespace: "shop"},
+		{name: "own shard", filter: controller.NamespaceFilter{Shard: controller.Shard{ID: 0, Count: 2}}, namespace: "shop", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Allows(tt.namespace))
+		})
+	}
+}
+
+func TestNamespaceFilter_CacheNamespaces(t *testing.T) {
+	assert.Nil(t, controller.NamespaceFilter{}.CacheNamespaces(nil))
+
+	watched := controller.NamespaceFilter{Watch: []string{"shop", "kube-system"}, Exclude: controller.DefaultExcludedNamespaces}
+	assert.Equal(t, map[string]cache.Config{"shop": {}}, watched.CacheNamespaces(nil))
+
+	excluded := controller.NamespaceFilter{Exclude: []string{"kube-system", "kube-public"}}
+	reason := fields.OneTermEqualSelector("reason", "EvictedByVPA")
+	namespaces := excluded.CacheNamespaces(reason)
+	assert.Len(t, namespaces, 1)
+	assert.Equal(t, "reason=EvictedByVPA,metadata.namespace!=kube-system,metadata.namespace!=kube-public",
+		namespaces[cache.AllNamespaces].FieldSelector.String())
+}
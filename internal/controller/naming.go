@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// vpaNames returns the names the managed VPA of the workload may have: the name
+// rendered by the naming template of the configuration, <name>-vpa by default,
+// then <name>-<kind>-vpa used as a fallback when the first one is taken.
+func (r *VPAControllerReconciler) vpaNames(obj client.Object) []string {
+	fallback := obj.GetName() + "-" + strings.ToLower(getKind(obj)) + "-vpa"
+	name, err := currentConfig(r.Config).VPAName(obj.GetName(), obj.GetNamespace(), getKind(obj))
+	if err != nil || name == fallback {
+		return []string{fallback}
+	}
+	return []string{name, fallback}
+}
+
+// resolveVPAName returns the name of the managed VPA of the workload, and the VPA
+// if it already exists, whatever its name. Otherwise, names taken by a VPA the
+// workload does not control are skipped, and returned as conflicts. The name is
+// empty if none is available.
+func (r *VPAControllerReconciler) resolveVPAName(ctx context.Context, obj client.Object) (string, *autoscalingv1.VerticalPodAutoscaler, []autoscalingv1.VerticalPodAutoscaler, error) {
+	current, ok, err := managedVPAFor(ctx, r.Client, obj, currentKeys(r.Config))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if ok {
+		return current.Name, current, nil, nil
+	}
+
+	names := r.vpaNames(obj)
+	if !r.NameFallback {
+		names = names[:1]
+	}
+
+	free := ""
+	var conflicts []autoscalingv1.VerticalPodAutoscaler
+	for _, name := range names {
+		var vpa autoscalingv1.VerticalPodAutoscaler
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}, &vpa)
+		if errors.IsNotFound(err) {
+			if free == "" {
+				free = name
+			}
+			continue
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if metav1.IsControlledBy(&vpa, obj) {
+			return name, &vpa, conflicts, nil
+		}
+		conflicts = append(conflicts, vpa)
+	}
+	return free, nil, conflicts, nil
+}
+
+// managedVPAFor returns the VPA of the workload managed by the instance of the
+// controller using the keys, or false if it has none.
+func managedVPAFor(ctx context.Context, c client.Reader, obj client.Object, keys annotations.Keys) (*autoscalingv1.VerticalPodAutoscaler, bool, error) {
+	vpas, err := vpasTargeting(ctx, c, obj.GetNamespace(), getKind(obj), obj.GetName())
+	if err != nil {
+		return nil, false, err
+	}
+	for i := range vpas {
+		if isManagedVPA(&vpas[i], keys) && metav1.IsControlledBy(&vpas[i], obj) {
+			return &vpas[i], true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// describeTarget describes what the VPA targets, for events.
+func describeTarget(vpa *autoscalingv1.VerticalPodAutoscaler) string {
+	if vpa.Spec.TargetRef == nil {
+		return "nothing"
+	}
+	return fmt.Sprintf("%s %s", vpa.Spec.TargetRef.Kind, vpa.Spec.TargetRef.Name)
+}
@@ -0,0 +1,145 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// collidingVPA returns a web-vpa VPA managed for the StatefulSet web.
+func collidingVPA() *autoscalingv1.VerticalPodAutoscaler {
+	owner := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "sts-uid"}}
+	vpa := managedVPA("web-vpa", owner)
+	vpa.OwnerReferences[0].Kind = "StatefulSet"
+	vpa.Spec.TargetRef = &autoscalingcorev1.CrossVersionObjectReference{Kind: "StatefulSet", Name: "web", APIVersion: "apps/v1"}
+	return vpa
+}
+
+func reconcileCollision(t *testing.T, fallback bool) (*controller.VPAControllerReconciler, *record.FakeRecorder, client.Client) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			UID:         "web-uid",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+		Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, collidingVPA()).
+		WithInterceptorFuncs(applyAsMergePatch).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAControllerReconciler{
+		Client:       fakeClient,
+		Scheme:       scheme,
+		Metrics:      metrics.NewCollectors(),
+		Recorder:     recorder,
+		NameFallback: fallback,
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+	})
+	require.NoError(t, err)
+	return r, recorder, fakeClient
+}
+
+func TestReconcile_ReportsNameConflict(t *testing.T) {
+	r, recorder, fakeClient := reconcileCollision(t, false)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &vpa))
+	assert.Equal(t, "StatefulSet", vpa.Spec.TargetRef.Kind, "the VPA of the other workload must be left alone")
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	assert.Len(t, vpas.Items, 1)
+
+	require.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "VPANameConflict")
+	assert.Contains(t, event, "web-vpa (targets StatefulSet web)")
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPANameConflict.WithLabelValues("Deployment", "default", "web")))
+}
+
+func TestReconcile_FallsBackToAlternativeName(t *testing.T) {
+	r, recorder, fakeClient := reconcileCollision(t, true)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-deployment-vpa"}, &vpa))
+	assert.Equal(t, "Deployment", vpa.Spec.TargetRef.Kind)
+	assert.Equal(t, "web", vpa.Spec.TargetRef.Name)
+
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "VPANameFallback")
+	assert.Equal(t, 0, testutil.CollectAndCount(r.Metrics.VPANameConflict))
+
+	// The fallback VPA is found again on the next reconcile.
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+	})
+	require.NoError(t, err)
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(context.TODO(), &vpas))
+	assert.Len(t, vpas.Items, 2)
+	assert.Empty(t, recorder.Events)
+}
+
+func TestReconcile_FindsManagedVPAByTarget(t *testing.T) {
+	scheme := setupScheme(t)
+	ctx := context.TODO()
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			UID:         "web-uid",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+	}
+	// A managed VPA created under a name the current naming convention does not produce.
+	vpa := managedVPA("legacy-web", dep)
+	vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeOff)}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).
+		WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(ctx, &vpas))
+	require.Len(t, vpas.Items, 1)
+	assert.Equal(t, "legacy-web", vpas.Items[0].Name)
+	assert.Equal(t, 0.0, testutil.ToFloat64(r.Metrics.VPACreated.WithLabelValues("Deployment", "default")))
+}
+
+func TestIndexVPATargetRef(t *testing.T) {
+	vpa := collidingVPA()
+	assert.Equal(t, []string{"StatefulSet/web"}, controller.IndexVPATargetRef(vpa))
+
+	vpa.Spec.TargetRef = nil
+	assert.Empty(t, controller.IndexVPATargetRef(vpa))
+}
@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// OOMKillReconciler raises the memory minAllowed of the managed VPA of a workload
+// whose containers get OOM killed.
+type OOMKillReconciler struct {
+	client.Client
+	// APIReader is used to resolve the owners of the pods without caching every
+	// ReplicaSet of the cluster.
+	APIReader client.Reader
+	Metrics   *metrics.Collectors
+	Recorder  record.EventRecorder
+	// BumpFactor is the factor applied to the memory floor of a container on each OOM kill.
+	BumpFactor float64
+	// MaxMemory is the cap the memory floor is never raised above.
+	MaxMemory resource.Quantity
+	// Namespaces restricts the namespaces the reconciler handles.
+	Namespaces NamespaceFilter
+	// Backoff bounds the retries of failed reconciles.
+	Backoff Backoff
+	// Config holds the configuration of the controller, reloaded on change.
+	// Defaults to config.Default().
+	Config *config.Store
+}
+
+func (r *OOMKillReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var pod corev1.Pod
+	if err := r.Client.Get(ctx, req.NamespacedName, &pod); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get pod", "name", req.NamespacedName)
+		return ctrl.Result{}, err
+	}
+
+	oomKilled := oomKilledContainers(&pod)
+	if len(oomKilled) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	workload, ok, err := workloadForPod(ctx, r.APIReader, &pod)
+	if err != nil || !ok {
+		return ctrl.Result{}, err
+	}
+
+	obj, err := getWorkload(ctx, r.Client, workload.Kind, client.ObjectKey{Namespace: workload.Namespace, Name: workload.Name})
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	keys := currentKeys(r.Config)
+	if obj.GetAnnotations()[keys.VPAEnabled] != "true" {
+		return ctrl.Result{}, nil
+	}
+
+	vpa, ok, err := managedVPAFor(ctx, r.Client, obj, keys)
+	if err != nil || !ok {
+		return ctrl.Result{}, err
+	}
+
+	// The last-oom-bump-at annotation records when the memory floor was last
+	// raised, so an OOM kill is only handled once.
+	var lastBump time.Time
+	if v, ok := vpa.Annotations[keys.LastOOMBumpAt]; ok {
+		lastBump, _ = time.Parse(time.RFC3339, v)
+	}
+
+	patch := client.MergeFrom(vpa.DeepCopy())
+	raised := map[string]resource.Quantity{}
+	for name, finishedAt := range oomKilled {
+		if !finishedAt.After(lastBump) {
+			continue
+		}
+		if floor, ok := r.raiseMemoryFloor(vpa, &pod, name); ok {
+			raised[name] = floor
+		}
+	}
+	if len(raised) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	if vpa.Annotations == nil {
+		vpa.Annotations = map[string]string{}
+	}
+	vpa.Annotations[keys.LastOOMBumpAt] = time.Now().UTC().Format(time.RFC3339)
+	if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+		logger.Error(err, "Failed to raise VPA memory floor", "name", vpa.Name)
+		return ctrl.Result{}, err
+	}
+
+	for name, floor := range raised {
+		logger.Info("Raised VPA memory floor after OOM kill", "name", vpa.Name, "container", name, "minAllowed", floor.String())
+		r.Recorder.Event(obj, corev1.EventTypeWarning, "MemoryFloorRaised",
+			fmt.Sprintf("Container %s was OOM killed, raised memory minAllowed of VPA %s to %s", name, vpa.Name, floor.String()))
+		r.Metrics.OOMMemoryFloorRaised.WithLabelValues(workload.Kind, workload.Namespace, workload.Name, name).Inc()
+	}
+	return ctrl.Result{}, nil
+}
+
+// raiseMemoryFloor multiplies the memory minAllowed of the container by the bump
+// factor, starting from the recommendation or the pod request when no floor is set.
+// It returns the new floor, or false if it could not be raised.
+func (r *OOMKillReconciler) raiseMemoryFloor(vpa *autoscalingv1.VerticalPodAutoscaler, pod *corev1.Pod, container string) (resource.Quantity, bool) {
+	var minAllowed, maxAllowed corev1.ResourceList
+	if vpa.Spec.ResourcePolicy != nil {
+		for _, p := range vpa.Spec.ResourcePolicy.ContainerPolicies {
+			if p.ContainerName == container {
+				minAllowed, maxAllowed = p.MinAllowed, p.MaxAllowed
+			}
+		}
+	}
+
+	base := minAllowed[corev1.ResourceMemory]
+	if base.IsZero() && vpa.Status.Recommendation != nil {
+		for _, rec := range vpa.Status.Recommendation.ContainerRecommendations {
+			if rec.ContainerName == container {
+				base = rec.Target[corev1.ResourceMemory]
+			}
+		}
+	}
+	if base.IsZero() {
+		for _, c := range pod.Spec.Containers {
+			if c.Name == container {
+				base = c.Resources.Requests[corev1.ResourceMemory]
+			}
+		}
+	}
+	if base.IsZero() {
+		return resource.Quantity{}, false
+	}
+
+	floor := *resource.NewQuantity(int64(float64(base.Value())*r.BumpFactor), resource.BinarySI)
+	if !r.MaxMemory.IsZero() && floor.Cmp(r.MaxMemory) > 0 {
+		floor = r.MaxMemory.DeepCopy()
+	}
+	if limit, ok := maxAllowed[corev1.ResourceMemory]; ok && floor.Cmp(limit) > 0 {
+		floor = limit.DeepCopy()
+	}
+	current := minAllowed[corev1.ResourceMemory]
+	if floor.Cmp(current) <= 0 {
+		return resource.Quantity{}, false
+	}
+
+	policy := containerPolicy(vpa, container)
+	if policy.MinAllowed == nil {
+		policy.MinAllowed = corev1.ResourceList{}
+	}
+	policy.MinAllowed[corev1.ResourceMemory] = floor
+	return floor, true
+}
+
+// containerPolicy returns the resource policy of the container in the VPA, adding
+// an empty one if it does not exist yet.
+func containerPolicy(vpa *autoscalingv1.VerticalPodAutoscaler, container string) *autoscalingv1.ContainerResourcePolicy {
+	if vpa.Spec.ResourcePolicy == nil {
+		vpa.Spec.ResourcePolicy = &autoscalingv1.PodResourcePolicy{}
+	}
+	policies := vpa.Spec.ResourcePolicy.ContainerPolicies
+	for i := range policies {
+		if policies[i].ContainerName == container {
+			return &policies[i]
+		}
+	}
+	vpa.Spec.ResourcePolicy.ContainerPolicies = append(policies, autoscalingv1.ContainerResourcePolicy{ContainerName: container})
+	return &vpa.Spec.ResourcePolicy.ContainerPolicies[len(policies)]
+}
+
+// oomKilledContainers returns the containers of the pod whose last termination
+// was an OOM kill, with the time it happened.
+func oomKilledContainers(pod *corev1.Pod) map[string]time.Time {
+	containers := map[string]time.Time{}
+	for _, status := range pod.Status.ContainerStatuses {
+		for _, terminated := range []*corev1.ContainerStateTerminated{status.State.Terminated, status.LastTerminationState.Terminated} {
+			if terminated != nil && terminated.Reason == "OOMKilled" && terminated.FinishedAt.Time.After(containers[status.Name]) {
+				containers[status.Name] = terminated.FinishedAt.Time
+			}
+		}
+	}
+	return containers
+}
+
+// TransformPod is the cache transform of the pods watched by the
+// OOMKillReconciler. A pod is stripped down to what the reconciler reads: its
+// owner references, the resources of its containers and their terminations, so
+// the cluster-wide pod informer does not hold the full pods.
+func TransformPod(obj any) (any, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+
+	stripped := &corev1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			ResourceVersion:   pod.ResourceVersion,
+			CreationTimestamp: pod.CreationTimestamp,
+			DeletionTimestamp: pod.DeletionTimestamp,
+			OwnerReferences:   pod.OwnerReferences,
+		},
+	}
+	for _, c := range pod.Spec.Containers {
+		stripped.Spec.Containers = append(stripped.Spec.Containers, corev1.Container{Name: c.Name, Resources: c.Resources})
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		stripped.Status.ContainerStatuses = append(stripped.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:                 status.Name,
+			State:                corev1.ContainerState{Terminated: status.State.Terminated},
+			LastTerminationState: corev1.ContainerState{Terminated: status.LastTerminationState.Terminated},
+		})
+	}
+	return stripped, nil
+}
+
+func (r *OOMKillReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	hasOOMKill := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		pod, ok := o.(*corev1.Pod)
+		return ok && len(oomKilledContainers(pod)) > 0
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("vpauto-oomkills").
+		WithEventFilter(r.Namespaces.Predicate()).
+		WithOptions(controller.Options{RateLimiter: r.Backoff.rateLimiter()}).
+		For(&corev1.Pod{}, builder.WithPredicates(hasOOMKill)).
+		Complete(r)
+}
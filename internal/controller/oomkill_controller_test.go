@@ -0,0 +1,173 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func oomKilledPod(finishedAt time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-0",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", UID: "db-uid", Controller: ptr.To(true),
+			}},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "postgres",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "postgres",
+				LastTerminationState: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", FinishedAt: metav1.NewTime(finishedAt)},
+				},
+			}},
+		},
+	}
+}
+
+func managedStatefulSetVPA() (*appsv1.StatefulSet, *autoscalingv1.VerticalPodAutoscaler) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "default",
+			UID:         "db-uid",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+	}
+	vpa := &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-vpa",
+			Namespace: "default",
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "vpauto-creation-controller"},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "StatefulSet",
+				Name:       "db",
+				UID:        "db-uid",
+				Controller: ptr.To(true),
+			}},
+		},
+		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+			TargetRef: &autoscalingcorev1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db"},
+		},
+	}
+	return sts, vpa
+}
+
+func TestOOMKill_RaisesMemoryFloorFromRequest(t *testing.T) {
+	scheme := setupScheme(t)
+
+	sts, vpa := managedStatefulSetVPA()
+	pod := oomKilledPod(time.Now().Add(-time.Minute))
+
+	fakeClient := newClientBuilder(scheme).WithObjects(sts, vpa, pod).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.OOMKillReconciler{
+		Client:     fakeClient,
+		APIReader:  fakeClient,
+		Metrics:    metrics.NewCollectors(),
+		Recorder:   recorder,
+		BumpFactor: 1.5,
+		MaxMemory:  resource.MustParse("1Gi"),
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "db-0"}}
+
+	_, err := r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	var updated autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "db-vpa"}, &updated))
+	require.Len(t, updated.Spec.ResourcePolicy.ContainerPolicies, 1)
+	floor := updated.Spec.ResourcePolicy.ContainerPolicies[0].MinAllowed[corev1.ResourceMemory]
+	assert.Equal(t, "384Mi", floor.String())
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.OOMMemoryFloorRaised.WithLabelValues("StatefulSet", "default", "db", "postgres")))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning MemoryFloorRaised")
+
+	// The same OOM kill must not raise the floor twice.
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "db-vpa"}, &updated))
+	floor = updated.Spec.ResourcePolicy.ContainerPolicies[0].MinAllowed[corev1.ResourceMemory]
+	assert.Equal(t, "384Mi", floor.String())
+}
+
+func TestOOMKill_NeverExceedsCap(t *testing.T) {
+	scheme := setupScheme(t)
+
+	sts, vpa := managedStatefulSetVPA()
+	vpa.Spec.ResourcePolicy = &autoscalingv1.PodResourcePolicy{
+		ContainerPolicies: []autoscalingv1.ContainerResourcePolicy{{
+			ContainerName: "postgres",
+			MinAllowed:    corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("900Mi")},
+		}},
+	}
+	pod := oomKilledPod(time.Now().Add(-time.Minute))
+
+	fakeClient := newClientBuilder(scheme).WithObjects(sts, vpa, pod).Build()
+	r := &controller.OOMKillReconciler{
+		Client:     fakeClient,
+		APIReader:  fakeClient,
+		Metrics:    metrics.NewCollectors(),
+		Recorder:   record.NewFakeRecorder(10),
+		BumpFactor: 2,
+		MaxMemory:  resource.MustParse("1Gi"),
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "db-0"},
+	})
+	require.NoError(t, err)
+
+	var updated autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "db-vpa"}, &updated))
+	floor := updated.Spec.ResourcePolicy.ContainerPolicies[0].MinAllowed[corev1.ResourceMemory]
+	assert.Equal(t, "1Gi", floor.String())
+}
+
+func TestTransformPod_KeepsWhatOOMKillsNeed(t *testing.T) {
+	pod := oomKilledPod(time.Now().Add(-time.Minute))
+	pod.ResourceVersion = "42"
+	pod.Labels = map[string]string{"app": "db"}
+	pod.Annotations = map[string]string{"checksum/config": "abc"}
+	pod.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubelet"}}
+	pod.Spec.Containers[0].Image = "postgres:16"
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "PGDATA", Value: "/var/lib/postgresql/data"}}
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+	pod.Status.ContainerStatuses[0].Image = "postgres:16"
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+
+	obj, err := controller.TransformPod(pod)
+	require.NoError(t, err)
+	stripped := obj.(*corev1.Pod)
+
+	want := oomKilledPod(pod.Status.ContainerStatuses[0].LastTerminationState.Terminated.FinishedAt.Time)
+	want.ResourceVersion = "42"
+	assert.Equal(t, want, stripped)
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadRef identifies a Deployment, DaemonSet or StatefulSet.
+type workloadRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// workloadForPod follows the controller owner references of the pod up to its
+// Deployment, DaemonSet or StatefulSet. It returns false if the pod is not owned
+// by one of the supported workloads.
+func workloadForPod(ctx context.Context, reader client.Reader, pod *corev1.Pod) (workloadRef, bool, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return workloadRef{}, false, nil
+	}
+
+	switch ref.Kind {
+	case "DaemonSet", "StatefulSet":
+		return workloadRef{Kind: ref.Kind, Namespace: pod.Namespace, Name: ref.Name}, true, nil
+	case "ReplicaSet":
+		return workloadForReplicaSet(ctx, reader, pod.Namespace, ref.Name)
+	}
+	return workloadRef{}, false, nil
+}
+
+// workloadForPodName guesses the workload of a pod that no longer exists from
+// its name: the pods of a ReplicaSet are named after it with a random suffix,
+// and the ReplicaSet of a Deployment is followed up to it. It returns false if
+// no Deployment is found this way.
+func workloadForPodName(ctx context.Context, reader client.Reader, namespace, name string) (workloadRef, bool, error) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return workloadRef{}, false, nil
+	}
+	return workloadForReplicaSet(ctx, reader, namespace, name[:i])
+}
+
+// workloadForReplicaSet returns the Deployment controlling the ReplicaSet. It
+// returns false if the ReplicaSet is gone or not controlled by a Deployment.
+func workloadForReplicaSet(ctx context.Context, reader client.Reader, namespace, name string) (workloadRef, bool, error) {
+	var rs appsv1.ReplicaSet
+	if err := reader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &rs); err != nil {
+		return workloadRef{}, false, client.IgnoreNotFound(err)
+	}
+	if rsRef := metav1.GetControllerOf(&rs); rsRef != nil && rsRef.Kind == "Deployment" {
+		return workloadRef{Kind: "Deployment", Namespace: namespace, Name: rsRef.Name}, true, nil
+	}
+	return workloadRef{}, false, nil
+}
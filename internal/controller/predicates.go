@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// WorkloadChanges filters out the updates of a workload that cannot change its
+// VPA, such as the status updates of a rollout. Only updates of the controller
+// annotations, of the labels, of the spec (including the pod template containers,
+// tracked by the generation as only the metadata of the workloads is watched) and
+// of the deletion pass, as well as every create and delete. The controller
+// annotations are the ones under the current prefix. The periodic resyncs of the
+// informer, whose old and new objects have the same resource version, go through
+// too, as they are the only periodic reconciles of the workloads. The filtered
+// updates are counted in filtered, labelled with the kind of the workload.
+func WorkloadChanges(kind string, prefix func() string, filtered *prometheus.CounterVec) predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return true
+			}
+			if e.ObjectOld.GetResourceVersion() == e.ObjectNew.GetResourceVersion() {
+				return true
+			}
+			if workloadChanged(e.ObjectOld, e.ObjectNew, prefix()) {
+				return true
+			}
+			filtered.WithLabelValues(kind).Inc()
+			return false
+		},
+	}
+}
+
+func workloadChanged(oldObj, newObj client.Object, prefix string) bool {
+	return oldObj.GetGeneration() != newObj.GetGeneration() ||
+		!maps.Equal(oldObj.GetLabels(), newObj.GetLabels()) ||
+		!maps.Equal(controllerAnnotations(oldObj, prefix), controllerAnnotations(newObj, prefix)) ||
+		!oldObj.GetDeletionTimestamp().Equal(newObj.GetDeletionTimestamp()) ||
+		!slices.Equal(oldObj.GetFinalizers(), newObj.GetFinalizers())
+}
+
+// controllerAnnotations returns the annotations of the object under the prefix.
+func controllerAnnotations(o client.Object, prefix string) map[string]string {
+	found := map[string]string{}
+	for k, v := range o.GetAnnotations() {
+		if strings.HasPrefix(k, prefix) {
+			found[k] = v
+		}
+	}
+	return found
+}
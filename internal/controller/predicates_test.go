@@ -0,0 +1,68 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func TestWorkloadChanges(t *testing.T) {
+	old := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web",
+			Namespace:       "default",
+			Generation:      1,
+			ResourceVersion: "1",
+			Labels:          map[string]string{"app": "web"},
+			Annotations:     map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true", "deployment.kubernetes.io/revision": "1"},
+		},
+	}
+
+	prefix := func() string { return annotations.Prefix }
+
+	tests := []struct {
+		name   string
+		update func(*appsv1.Deployment)
+		want   bool
+	}{
+		{name: "status update", update: func(d *appsv1.Deployment) { d.Status.ReadyReplicas = 3 }},
+		{name: "other annotation", update: func(d *appsv1.Deployment) { d.Annotations["deployment.kubernetes.io/revision"] = "2" }},
+		{name: "controller annotation", update: func(d *appsv1.Deployment) {
+			d.Annotations["k8s.autoscaling.vpacreation/update-mode"] = "Auto"
+		}, want: true},
+		{name: "label", update: func(d *appsv1.Deployment) { d.Labels["team"] = "payments" }, want: true},
+		{name: "spec", update: func(d *appsv1.Deployment) { d.Generation = 2 }, want: true},
+		{name: "deletion", update: func(d *appsv1.Deployment) { d.DeletionTimestamp = &metav1.Time{} }, want: true},
+		{name: "resync", update: func(d *appsv1.Deployment) { d.ResourceVersion = "1" }, want: true},
+		{name: "finalizer", update: func(d *appsv1.Deployment) { d.Finalizers = []string{"example.com/finalizer"} }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collectors := metrics.NewCollectors()
+			p := controller.WorkloadChanges("Deployment", prefix, collectors.FilteredWorkloadEvents)
+
+			updated := old.DeepCopy()
+			updated.ResourceVersion = "2"
+			tt.update(updated)
+			assert.Equal(t, tt.want, p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}))
+
+			filtered := 1.0
+			if tt.want {
+				filtered = 0
+			}
+			assert.Equal(t, filtered, testutil.ToFloat64(collectors.FilteredWorkloadEvents.WithLabelValues("Deployment")))
+		})
+	}
+
+	p := controller.WorkloadChanges("Deployment", prefix, metrics.NewCollectors().FilteredWorkloadEvents)
+	assert.True(t, p.Create(event.CreateEvent{Object: old}))
+	assert.True(t, p.Delete(event.DeleteEvent{Object: old}))
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// migrateVPAs moves the VPAs targeting the workload that were labelled under a
+// previous annotation prefix to the current one: they are relabelled, and their
+// annotations under the previous prefix renamed under the current one.
+func (r *VPAControllerReconciler) migrateVPAs(ctx context.Context, obj client.Object) error {
+	cfg := currentConfig(r.Config)
+	previous := cfg.PreviousKeys()
+	if len(previous) == 0 {
+		return nil
+	}
+	keys := cfg.Keys()
+
+	vpas, err := vpasTargeting(ctx, r.Client, obj.GetNamespace(), getKind(obj), obj.GetName())
+	if err != nil {
+		return err
+	}
+	for i := range vpas {
+		vpa := &vpas[i]
+		for _, prev := range previous {
+			if !isManagedVPA(vpa, prev) {
+				continue
+			}
+			patch := client.MergeFrom(vpa.DeepCopy())
+			metav1.SetMetaDataLabel(&vpa.ObjectMeta, annotations.ManagedBy, keys.ManagedByValue)
+			for k, v := range vpa.Annotations {
+				if name, ok := strings.CutPrefix(k, prev.Prefix); ok {
+					delete(vpa.Annotations, k)
+					vpa.Annotations[keys.Prefix+name] = v
+				}
+			}
+			if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+				return err
+			}
+			log.FromContext(ctx).Info("Moved VPA to the current annotation prefix", "name", vpa.Name, "previousPrefix", prev.Prefix)
+			break
+		}
+	}
+	return nil
+}
+
+// previousRetainFinalizers returns the retain finalizers of the previous
+// annotation prefixes the workload carries.
+func (r *VPAControllerReconciler) previousRetainFinalizers(obj client.Object) []string {
+	var finalizers []string
+	for _, prev := range currentConfig(r.Config).PreviousKeys() {
+		if controllerutil.ContainsFinalizer(obj, prev.RetainFinalizer) {
+			finalizers = append(finalizers, prev.RetainFinalizer)
+		}
+	}
+	return finalizers
+}
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=deployments;daemonsets;statefulsets,verbs=patch
+
+// Deletion policies of the managed VPAs.
+const (
+	// DeletionPolicyDelete deletes the VPA with its workload through its owner reference.
+	DeletionPolicyDelete = "Delete"
+	// DeletionPolicyRetain detaches the VPA from its workload when the workload is
+	// deleted, so its recommendation history survives a redeploy.
+	DeletionPolicyRetain = "Retain"
+)
+
+// deletionPolicyFor returns the deletion policy requested by the workload
+// annotations, or the default policy of the reconciler.
+func (r *VPAControllerReconciler) deletionPolicyFor(obj client.Object) string {
+	if policy, ok := obj.GetAnnotations()[currentKeys(r.Config).DeletionPolicy]; ok {
+		return policy
+	}
+	if r.DeletionPolicy == "" {
+		return DeletionPolicyDelete
+	}
+	return r.DeletionPolicy
+}
+
+// ensureRetainFinalizer adds the retain finalizer to an opted-in workload with
+// the Retain policy, and removes it otherwise. The finalizer holds the deletion
+// of the workload until its VPA is detached. The retain finalizers of the
+// previous annotation prefixes are replaced by the current one.
+func (r *VPAControllerReconciler) ensureRetainFinalizer(ctx context.Context, obj client.Object) error {
+	keys := currentKeys(r.Config)
+	want := obj.GetAnnotations()[keys.VPAEnabled] == "true" && r.deletionPolicyFor(obj) == DeletionPolicyRetain
+	previous := r.previousRetainFinalizers(obj)
+	if want == controllerutil.ContainsFinalizer(obj, keys.RetainFinalizer) && len(previous) == 0 {
+		return nil
+	}
+
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	if want {
+		controllerutil.AddFinalizer(obj, keys.RetainFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(obj, keys.RetainFinalizer)
+	}
+	for _, finalizer := range previous {
+		controllerutil.RemoveFinalizer(obj, finalizer)
+	}
+	return patchWorkload(ctx, r.Client, obj, patch)
+}
+
+// retainVPA detaches the managed VPA of a workload being deleted and marks it as
+// retained with the time of the deletion, then lets the deletion of the workload
+// go on. The VPA is garbage collected once the retention TTL has elapsed. The
+// retain finalizers of the previous annotation prefixes are honoured as well.
+func (r *VPAControllerReconciler) retainVPA(ctx context.Context, obj client.Object) error {
+	logger := log.FromContext(ctx)
+
+	keys := currentKeys(r.Config)
+	previous := r.previousRetainFinalizers(obj)
+	if !controllerutil.ContainsFinalizer(obj, keys.RetainFinalizer) && len(previous) == 0 {
+		return nil
+	}
+
+	vpa, ok, err := managedVPAFor(ctx, r.Client, obj, keys)
+	if err != nil {
+		return err
+	}
+	if ok {
+		patch := client.MergeFrom(vpa.DeepCopy())
+		var refs []metav1.OwnerReference
+		for _, ref := range vpa.OwnerReferences {
+			if ref.UID != obj.GetUID() {
+				refs = append(refs, ref)
+			}
+		}
+		vpa.OwnerReferences = refs
+		if vpa.Annotations == nil {
+			vpa.Annotations = map[string]string{}
+		}
+		vpa.Annotations[keys.RetainedAt] = time.Now().UTC().Format(time.RFC3339)
+		if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+			return err
+		}
+		logger.Info("Retained VPA of deleted workload", "name", vpa.Name, "ttl", r.RetainTTL)
+		r.Recorder.Event(obj, corev1.EventTypeNormal, "VPARetained",
+			fmt.Sprintf("VPA %s is retained for %s after the deletion of the workload", vpa.Name, r.RetainTTL))
+	}
+
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	controllerutil.RemoveFinalizer(obj, keys.RetainFinalizer)
+	for _, finalizer := range previous {
+		controllerutil.RemoveFinalizer(obj, finalizer)
+	}
+	return patchWorkload(ctx, r.Client, obj, patch)
+}
+
+// reattachRetainedVPA gives back to a workload recreated with the same name the
+// VPA retained from its previous incarnation.
+func (r *VPAControllerReconciler) reattachRetainedVPA(ctx context.Context, obj client.Object) error {
+	logger := log.FromContext(ctx)
+
+	vpas, err := vpasTargeting(ctx, r.Client, obj.GetNamespace(), getKind(obj), obj.GetName())
+	if err != nil {
+		return err
+	}
+	keys := currentKeys(r.Config)
+	for i := range vpas {
+		vpa := &vpas[i]
+		if _, ok := vpa.Annotations[keys.RetainedAt]; !ok || !isManagedVPA(vpa, keys) || !targets(vpa, obj) {
+			continue
+		}
+		if metav1.GetControllerOf(vpa) != nil {
+			continue
+		}
+
+		patch := client.MergeFrom(vpa.DeepCopy())
+		if err := ctrl.SetControllerReference(obj, vpa, r.Scheme); err != nil {
+			return err
+		}
+		delete(vpa.Annotations, keys.RetainedAt)
+		if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+			return err
+		}
+		logger.Info("Reattached retained VPA", "name", vpa.Name)
+		r.Recorder.Event(obj, corev1.EventTypeNormal, "VPAReattached",
+			fmt.Sprintf("Reattached VPA %s retained from a previous %s %s", vpa.Name, getKind(obj), obj.GetName()))
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func retainedDeployment(uid types.UID) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			UID:       uid,
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled":     "true",
+				"k8s.autoscaling.vpacreation/deletion-policy": "Retain",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+}
+
+func newRetainReconciler(c client.Client, recorder *record.FakeRecorder) *controller.VPAControllerReconciler {
+	return &controller.VPAControllerReconciler{
+		Client:    c,
+		Scheme:    c.Scheme(),
+		Metrics:   metrics.NewCollectors(),
+		Recorder:  recorder,
+		RetainTTL: 24 * time.Hour,
+	}
+}
+
+func TestRetain_DetachesVPAOnDeletionAndReattachesIt(t *testing.T) {
+	scheme := setupScheme(t)
+	ctx := context.TODO()
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(retainedDeployment("web-uid-1")).
+		WithInterceptorFuncs(applyAsMergePatch).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := newRetainReconciler(fakeClient, recorder)
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	var dep appsv1.Deployment
+	require.NoError(t, fakeClient.Get(ctx, req.NamespacedName, &dep))
+	assert.Contains(t, dep.Finalizers, annotations.DefaultKeys.RetainFinalizer)
+
+	// Deleting the workload detaches the VPA and releases the workload.
+	require.NoError(t, fakeClient.Delete(ctx, &dep))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	assert.True(t, errors.IsNotFound(fakeClient.Get(ctx, req.NamespacedName, &dep)))
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &vpa))
+	assert.Empty(t, vpa.OwnerReferences)
+	assert.Contains(t, vpa.Annotations, "k8s.autoscaling.vpacreation/retained-at")
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "VPARetained")
+
+	// A workload recreated with the same name gets its VPA back.
+	require.NoError(t, fakeClient.Create(ctx, retainedDeployment("web-uid-2")))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &vpa))
+	require.NotNil(t, metav1.GetControllerOf(&vpa))
+	assert.Equal(t, types.UID("web-uid-2"), metav1.GetControllerOf(&vpa).UID)
+	assert.NotContains(t, vpa.Annotations, "k8s.autoscaling.vpacreation/retained-at")
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "VPAReattached")
+
+	var vpas autoscalingv1.VerticalPodAutoscalerList
+	require.NoError(t, fakeClient.List(ctx, &vpas))
+	assert.Len(t, vpas.Items, 1)
+}
+
+func TestRetain_GarbageCollectsExpiredVPAs(t *testing.T) {
+	scheme := setupScheme(t)
+	ctx := context.TODO()
+
+	retained := func(name string, at time.Time) *autoscalingv1.VerticalPodAutoscaler {
+		return &autoscalingv1.VerticalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": "vpauto-creation-controller"},
+				Annotations: map[string]string{"k8s.autoscaling.vpacreation/retained-at": at.UTC().Format(time.RFC3339)},
+			},
+			Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+				TargetRef: &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: name, APIVersion: "apps/v1"},
+			},
+		}
+	}
+
+	fakeClient := newClientBuilder(scheme).
+		WithObjects(retained("fresh", time.Now().Add(-time.Hour)), retained("expired", time.Now().Add(-48*time.Hour))).
+		Build()
+	gc := &controller.GarbageCollector{Client: fakeClient, Metrics: metrics.NewCollectors(), RetainTTL: 24 * time.Hour}
+
+	require.NoError(t, gc.Collect(ctx))
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	assert.NoError(t, fakeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "fresh"}, &vpa))
+	assert.True(t, errors.IsNotFound(fakeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "expired"}, &vpa)))
+}
+
+func TestRetain_MigratesPreviousAnnotationPrefix(t *testing.T) {
+	scheme := setupScheme(t)
+	ctx := context.TODO()
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}}
+
+	previous := annotations.KeysFor("autoscaling.example.com/")
+	cfg := config.Default()
+	cfg.PreviousAnnotationPrefixes = []string{previous.Prefix}
+
+	dep := retainedDeployment("web-uid")
+	dep.Finalizers = []string{previous.RetainFinalizer}
+	vpa := &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-vpa",
+			Namespace:       "default",
+			Labels:          map[string]string{annotations.ManagedBy: previous.ManagedByValue},
+			Annotations:     map[string]string{previous.CreatedAt: "2024-01-01T00:00:00Z"},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(dep, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+		},
+		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+			TargetRef: &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"},
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := newRetainReconciler(fakeClient, record.NewFakeRecorder(10))
+	r.Config = config.NewStore(cfg)
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(ctx, req.NamespacedName, dep))
+	assert.Equal(t, []string{annotations.DefaultKeys.RetainFinalizer}, dep.Finalizers, "the previous finalizer is replaced")
+	require.NoError(t, fakeClient.Get(ctx, client.ObjectKeyFromObject(vpa), vpa))
+	assert.Equal(t, annotations.ManagedByValue, vpa.Labels[annotations.ManagedBy])
+	assert.Equal(t, "2024-01-01T00:00:00Z", vpa.Annotations["k8s.autoscaling.vpacreation/created-at"])
+	assert.NotContains(t, vpa.Annotations, previous.CreatedAt)
+}
+
+func TestRetain_ReleasesWorkloadWithPreviousFinalizer(t *testing.T) {
+	scheme := setupScheme(t)
+	ctx := context.TODO()
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}}
+
+	previous := annotations.KeysFor("autoscaling.example.com/")
+	cfg := config.Default()
+	cfg.PreviousAnnotationPrefixes = []string{previous.Prefix}
+
+	dep := retainedDeployment("web-uid")
+	dep.Annotations = nil
+	dep.Finalizers = []string{previous.RetainFinalizer}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := newRetainReconciler(fakeClient, record.NewFakeRecorder(10))
+	r.Config = config.NewStore(cfg)
+
+	require.NoError(t, fakeClient.Delete(ctx, dep))
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	assert.True(t, errors.IsNotFound(fakeClient.Get(ctx, req.NamespacedName, dep)), "the deletion is not blocked")
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Shard selects the namespaces handled by one of several controller replicas.
+// Namespaces are assigned to the shards by consistent hashing of their name, so
+// every replica agrees on the assignment without coordination, and changing the
+// number of shards only moves the namespaces of the added or removed shards.
+// The zero value owns every namespace.
+type Shard struct {
+	// ID is the shard of the replica, from 0 to Count-1.
+	ID int
+	// Count is the number of shards. Sharding is disabled below 2.
+	Count int
+}
+
+// Owns reports whether the namespace is assigned to the shard.
+func (s Shard) Owns(namespace string) bool {
+	if s.Count < 2 {
+		return true
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(namespace))
+	return jumpHash(h.Sum64(), s.Count) == s.ID
+}
+
+// jumpHash is the jump consistent hash of Lamping and Veach, mapping the key to
+// one of the buckets.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardFromHostname returns the shard of a replica from the ordinal suffix of its
+// hostname, such as 2 for vpa-creation-operator-2 in a StatefulSet.
+func ShardFromHostname(hostname string) (int, error) {
+	i := strings.LastIndex(hostname, "-")
+	id, err := strconv.Atoi(hostname[i+1:])
+	if i < 0 || err != nil || id < 0 {
+		return 0, fmt.Errorf("hostname %q does not end with a shard ordinal", hostname)
+	}
+	return id, nil
+}
@@ -0,0 +1,60 @@
+package controller_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+)
+
+// shardOf returns the shard owning the namespace among count shards.
+func shardOf(t *testing.T, namespace string, count int) int {
+	owner := -1
+	for id := range count {
+		if (controller.Shard{ID: id, Count: count}).Owns(namespace) {
+			require.Equal(t, -1, owner, "namespace %s owned by shards %d and %d", namespace, owner, id)
+			owner = id
+		}
+	}
+	require.NotEqual(t, -1, owner, "namespace %s owned by no shard", namespace)
+	return owner
+}
+
+func TestShard_SplitsNamespaces(t *testing.T) {
+	const namespaces = 4000
+	perShard := map[int]int{}
+	moved := 0
+	for i := range namespaces {
+		ns := fmt.Sprintf("team-%d", i)
+		before, after := shardOf(t, ns, 4), shardOf(t, ns, 5)
+		perShard[before]++
+		if before != after {
+			moved++
+			assert.Equal(t, 4, after, "namespaces only move to the added shard")
+		}
+	}
+
+	for id := range 4 {
+		assert.InDelta(t, namespaces/4, perShard[id], namespaces/20, "shard %d", id)
+	}
+	assert.InDelta(t, namespaces/5, moved, namespaces/20)
+}
+
+func TestShard_ZeroValueOwnsEverything(t *testing.T) {
+	assert.True(t, controller.Shard{}.Owns("shop"))
+	assert.True(t, controller.Shard{ID: 0, Count: 1}.Owns("shop"))
+}
+
+func TestShardFromHostname(t *testing.T) {
+	id, err := controller.ShardFromHostname("vpa-creation-operator-2")
+	require.NoError(t, err)
+	assert.Equal(t, 2, id)
+
+	for _, invalid := range []string{"vpa-creation-operator-7d9f8c5b4-x2x7q", "controller", ""} {
+		_, err := controller.ShardFromHostname(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
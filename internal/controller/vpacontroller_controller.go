@@ -2,10 +2,18 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
@@ -14,58 +22,56 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
 	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
 )
 
 // +kubebuilder:rbac:groups=apps,resources=deployments;daemonsets;statefulsets,verbs=get;list;watch
-// +kubebuilder:rbac:groups=autoscaling.k8s.io,resources=verticalpodautoscalers,verbs=get;list;create;watch
+// +kubebuilder:rbac:groups=autoscaling.k8s.io,resources=verticalpodautoscalers,verbs=get;list;create;watch;patch;delete
 // +kubebuilder:rbac:groups=autoscaling.k8s.io,resources=verticalpodautoscalers/status,verbs=get
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 type VPAControllerReconciler struct {
 	client.Client
-	Scheme  *runtime.Scheme
-	Metrics *metrics.Collectors
+	Scheme   *runtime.Scheme
+	Metrics  *metrics.Collectors
+	Recorder record.EventRecorder
+	// CorrectDrift reverts manual edits of the managed VPAs instead of leaving them be.
+	CorrectDrift bool
+	// NameFallback creates the VPA as <name>-<kind>-vpa when <name>-vpa is taken by
+	// a VPA of another workload, instead of only reporting the conflict.
+	NameFallback bool
+	// DeletionPolicy is the deletion policy of the workloads without the
+	// deletion-policy annotation. Defaults to Delete.
+	DeletionPolicy string
+	// RetainTTL is how long a VPA is retained after the deletion of its workload
+	// before it is garbage collected. Zero retains it forever.
+	RetainTTL time.Duration
+	// ExistingVPAPolicy is what to do when a workload is already targeted by a VPA
+	// the controller did not create, one of ExistingVPAPolicies. Defaults to Skip.
+	ExistingVPAPolicy string
+	// Namespaces restricts the namespaces the reconciler handles.
+	Namespaces NamespaceFilter
+	// Backoff bounds the retries of failed reconciles.
+	Backoff Backoff
+	// Config holds the configuration of the controller, reloaded on change.
+	// Defaults to config.Default().
+	Config *config.Store
 }
 
-const vpaAnnotationKey = "k8s.autoscaling.vpacreation/vpa-enabled"
-
 func (r *VPAControllerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
-	// Checking for the existence of VPA CRD
-	var vpaList autoscalingv1.VerticalPodAutoscalerList
-	err := r.Client.List(ctx, &vpaList)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			logger.Info("VPA CRD not found, will retry later")
-			return ctrl.Result{Requeue: true}, nil
-		}
-		logger.Error(err, "Failed to list VPA resources")
-		return ctrl.Result{}, err
-	}
-
-	// Clean up orphaned VPAs
-	for _, vpa := range vpaList.Items {
-		if vpa.OwnerReferences == nil || len(vpa.OwnerReferences) == 0 {
-			logger.Info("Deleting orphaned VPA", "name", vpa.Name)
-			r.Metrics.VPADeleted.WithLabelValues(vpa.Namespace).Inc()
-			_ = r.Client.Delete(ctx, &vpa)
-		}
-	}
-
-	kinds := []client.Object{
-		&appsv1.Deployment{},
-		&appsv1.DaemonSet{},
-		&appsv1.StatefulSet{},
-	}
-	for _, obj := range kinds {
-		obj = obj.DeepCopyObject().(client.Object)
-		obj.SetNamespace(req.Namespace)
-		obj.SetName(req.Name)
-		if err := r.Client.Get(ctx, req.NamespacedName, obj); err == nil {
+	// Only the metadata of the workloads is cached and needed to generate their VPA.
+	for _, kind := range workloadKinds {
+		obj, err := getWorkload(ctx, r.Client, kind, req.NamespacedName)
+		if err == nil {
 			return r.handleReconcile(ctx, obj)
 		} else if !errors.IsNotFound(err) {
 			return ctrl.Result{}, err
@@ -73,45 +79,140 @@ func (r *VPAControllerReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 
 	logger.Info("No matching resource found for request", "name", req.NamespacedName)
+	r.Metrics.VPANameConflict.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "name": req.Name})
 	return ctrl.Result{}, nil
 }
 
 func (r *VPAControllerReconciler) handleReconcile(ctx context.Context, obj client.Object) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
-	annotations := obj.GetAnnotations()
-	if val, ok := annotations[vpaAnnotationKey]; !ok || val != "true" {
+	if err := r.migrateVPAs(ctx, obj); err != nil {
+		logger.Error(err, "Failed to move VPAs to the current annotation prefix", "kind", getKind(obj), "name", obj.GetName())
+		return ctrl.Result{}, err
+	}
+	if !obj.GetDeletionTimestamp().IsZero() {
+		if err := r.retainVPA(ctx, obj); err != nil {
+			logger.Error(err, "Failed to retain VPA", "kind", getKind(obj), "name", obj.GetName())
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if err := r.ensureRetainFinalizer(ctx, obj); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	keys := currentKeys(r.Config)
+	if val, ok := obj.GetAnnotations()[keys.VPAEnabled]; !ok || val != "true" {
 		return ctrl.Result{}, nil
 	}
+	// The config annotation is parsed once, an invalid one is ignored.
+	wc, configErrs := workloadConfig(obj, keys)
 
-	vpaName := obj.GetName() + "-vpa"
-	var existingVPA autoscalingv1.VerticalPodAutoscaler
-	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: vpaName}, &existingVPA); errors.IsNotFound(err) {
-		selector := extractSelector(obj)
-		kind := getKind(obj)
-		vpa := r.generateVPA(vpaName, obj.GetNamespace(), selector, kind, obj)
-		logger.Info("Creating VPA", "name", vpa.Name)
-		if err := r.Client.Create(ctx, &vpa); err != nil {
-			logger.Error(err, "Failed to create VPA", "name", vpa.Name)
+	if err := r.reattachRetainedVPA(ctx, obj); err != nil {
+		logger.Error(err, "Failed to reattach retained VPA", "kind", getKind(obj), "name", obj.GetName())
+		return ctrl.Result{}, err
+	}
+
+	existing, adopted, err := r.existingVPAs(ctx, obj)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if adopted {
+		return ctrl.Result{}, nil
+	}
+	if len(existing) > 0 {
+		skip, err := r.handleExistingVPAs(ctx, obj, existing)
+		if err != nil {
+			logger.Error(err, "Failed to handle existing VPAs", "kind", getKind(obj), "name", obj.GetName())
 			return ctrl.Result{}, err
 		}
-		r.Metrics.VPACreated.WithLabelValues(kind, obj.GetNamespace()).Inc()
+		if skip {
+			return ctrl.Result{}, nil
+		}
 	}
 
-	return ctrl.Result{}, nil
-}
+	kind := getKind(obj)
+	vpaName, current, conflicts, err := r.resolveVPAName(ctx, obj)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(conflicts) > 0 {
+		taken := make([]string, 0, len(conflicts))
+		for _, vpa := range conflicts {
+			taken = append(taken, fmt.Sprintf("%s (targets %s)", vpa.Name, describeTarget(&vpa)))
+		}
+		if vpaName == "" {
+			logger.Info("VPA name is taken by a VPA of another workload", "kind", kind, "name", obj.GetName(), "vpas", taken)
+			r.Recorder.Event(obj, corev1.EventTypeWarning, "VPANameConflict",
+				fmt.Sprintf("Cannot create VPA, the name is taken: %s", strings.Join(taken, ", ")))
+			r.Metrics.VPANameConflict.WithLabelValues(kind, obj.GetNamespace(), obj.GetName()).Set(1)
+			return ctrl.Result{}, nil
+		}
+		if current == nil {
+			r.Recorder.Event(obj, corev1.EventTypeNormal, "VPANameFallback",
+				fmt.Sprintf("Creating VPA %s, the name is taken: %s", vpaName, strings.Join(taken, ", ")))
+		}
+	}
+	r.Metrics.VPANameConflict.DeleteLabelValues(kind, obj.GetNamespace(), obj.GetName())
 
-func extractSelector(obj runtime.Object) *metav1.LabelSelector {
-	switch o := obj.(type) {
-	case *appsv1.Deployment:
-		return o.Spec.Selector
-	case *appsv1.DaemonSet:
-		return o.Spec.Selector
-	case *appsv1.StatefulSet:
-		return o.Spec.Selector
-	default:
-		return &metav1.LabelSelector{}
+	if current != nil {
+		if !isManagedVPA(current, keys) {
+			return ctrl.Result{}, nil
+		}
+		if r.CorrectDrift {
+			if err := r.correctDrift(ctx, obj, wc, current); err != nil {
+				logger.Error(err, "Failed to revert manual edits of VPA", "name", vpaName)
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	vpa := r.desiredVPA(obj, wc, vpaName, current)
+	if len(configErrs) > 0 {
+		// The invalid value is recorded on the VPA, so it is only warned about once.
+		invalid := configHash(obj.GetAnnotations()[keys.Config])
+		if current == nil || current.Annotations[keys.InvalidConfig] != invalid {
+			logger.Info("Ignoring invalid VPA config annotation", "kind", kind, "name", obj.GetName(), "errors", configErrs.ToAggregate().Error())
+			r.Recorder.Event(obj, corev1.EventTypeWarning, "InvalidVPAConfig",
+				fmt.Sprintf("Ignoring invalid VPA config annotation: %v", configErrs.ToAggregate()))
+		}
+		metav1.SetMetaDataAnnotation(&vpa.ObjectMeta, keys.InvalidConfig, invalid)
+	}
+	if current != nil && upToDate(current, &vpa, keys) {
+		if err := r.inheritRecommendation(ctx, obj, current, false); err != nil {
+			logger.Error(err, "Failed to inherit recommendation", "name", vpaName)
+			return ctrl.Result{}, err
+		}
+		if err := r.excludeContainers(ctx, current); err != nil {
+			logger.Error(err, "Failed to exclude containers from VPA", "name", vpaName)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if current == nil {
+		logger.Info("Creating VPA", "name", vpa.Name)
+	}
+	applied, err := r.applyVPA(ctx, obj, &vpa)
+	if err != nil {
+		logger.Error(err, "Failed to apply VPA", "name", vpa.Name)
+		return ctrl.Result{}, err
 	}
+	if !applied {
+		return ctrl.Result{}, nil
+	}
+	if current == nil && !isDryRun(r.Client) {
+		r.Metrics.VPACreated.WithLabelValues(kind, obj.GetNamespace()).Inc()
+	}
+	if err := r.inheritRecommendation(ctx, obj, &vpa, current == nil); err != nil {
+		logger.Error(err, "Failed to inherit recommendation", "name", vpa.Name)
+		return ctrl.Result{}, err
+	}
+	if err := r.excludeContainers(ctx, &vpa); err != nil {
+		logger.Error(err, "Failed to exclude containers from VPA", "name", vpa.Name)
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
 }
 
 func getKind(obj client.Object) string {
@@ -122,43 +223,138 @@ func getKind(obj client.Object) string {
 		return "DaemonSet"
 	case *appsv1.StatefulSet:
 		return "StatefulSet"
+	case *metav1.PartialObjectMetadata:
+		if kind := obj.GetObjectKind().GroupVersionKind().Kind; slices.Contains(workloadKinds, kind) {
+			return kind
+		}
+		return "Unknown"
 	default:
 		return "Unknown"
 	}
 }
 
-func (r *VPAControllerReconciler) generateVPA(name, namespace string, selector *metav1.LabelSelector, kind string, owner client.Object) autoscalingv1.VerticalPodAutoscaler {
+// updateModeFor returns the update mode requested by the parsed config
+// annotation of the workload, else by its update-mode annotation, or the default update mode
+// of the configuration without annotation. Unknown values fall back to Off.
+func updateModeFor(obj client.Object, wc *annotations.WorkloadConfig, cfg *config.Configuration) autoscalingv1.UpdateMode {
+	mode, ok := obj.GetAnnotations()[cfg.Keys().UpdateMode]
+	if wc != nil && wc.UpdateMode != "" {
+		mode, ok = wc.UpdateMode, true
+	}
+	if !ok {
+		mode = cfg.DefaultUpdateMode
+	}
+	switch mode := autoscalingv1.UpdateMode(mode); mode {
+	case autoscalingv1.UpdateModeOff, autoscalingv1.UpdateModeInitial, autoscalingv1.UpdateModeRecreate, autoscalingv1.UpdateModeAuto:
+		return mode
+	default:
+		return autoscalingv1.UpdateModeOff
+	}
+}
+
+// workloadKinds are the kinds of workloads the controller creates VPAs for.
+var workloadKinds = []string{"Deployment", "DaemonSet", "StatefulSet"}
+
+// newWorkload returns empty metadata for one of the supported workload kinds, or nil.
+// The workloads are only watched through their metadata, so that their pod
+// templates are not cached.
+func newWorkload(kind string) client.Object {
+	if !slices.Contains(workloadKinds, kind) {
+		return nil
+	}
+	obj := &metav1.PartialObjectMetadata{}
+	obj.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind(kind))
+	return obj
+}
+
+// getWorkload gets the metadata of a workload of the given kind.
+func getWorkload(ctx context.Context, reader client.Reader, kind string, key client.ObjectKey) (client.Object, error) {
+	obj := newWorkload(kind)
+	if obj == nil {
+		return nil, errors.NewNotFound(appsv1.Resource(strings.ToLower(kind)+"s"), key.Name)
+	}
+	if err := reader.Get(ctx, key, obj); err != nil {
+		return nil, err
+	}
+	// The kind identifies the workload for the owner references and events.
+	obj.GetObjectKind().SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind(kind))
+	return obj, nil
+}
+
+// patchWorkload patches the metadata of a workload, keeping its kind which is not
+// always set on the patched metadata.
+func patchWorkload(ctx context.Context, c client.Client, obj client.Object, patch client.Patch) error {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	err := c.Patch(ctx, obj, patch)
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	return err
+}
+
+// isManagedVPA reports whether the VPA was created by the instance of the
+// controller using the keys.
+func isManagedVPA(o client.Object, keys annotations.Keys) bool {
+	return o.GetLabels()[annotations.ManagedBy] == keys.ManagedByValue
+}
+
+// generateVPA returns the VPA of the workload, configured by its parsed config
+// annotation wc when not nil.
+func (r *VPAControllerReconciler) generateVPA(name, namespace, kind string, owner client.Object, wc *annotations.WorkloadConfig) autoscalingv1.VerticalPodAutoscaler {
+	cfg := currentConfig(r.Config)
 	vpa := autoscalingv1.VerticalPodAutoscaler{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: autoscalingv1.SchemeGroupVersion.String(),
+			Kind:       "VerticalPodAutoscaler",
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
+			Labels: map[string]string{
+				annotations.ManagedBy: cfg.Keys().ManagedByValue,
+			},
 		},
 		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
 			TargetRef: &autoscalingcorev1.CrossVersionObjectReference{
 				Kind:       kind,
-				Name:       name[:len(name)-4], // strip "-vpa"
+				Name:       owner.GetName(),
 				APIVersion: "apps/v1",
 			},
 			UpdatePolicy: &autoscalingv1.PodUpdatePolicy{
 				UpdateMode: func() *autoscalingv1.UpdateMode {
-					mode := autoscalingv1.UpdateModeOff
+					mode := updateModeFor(owner, wc, cfg)
 					return &mode
 				}(),
 			},
 		},
 	}
+	applyWorkloadConfig(&vpa, owner, wc, cfg)
 	_ = ctrl.SetControllerReference(owner, &vpa, r.Scheme)
 	return vpa
 }
 
 func (r *VPAControllerReconciler) SetupWithManagerFor(obj client.Object, mgr ctrl.Manager) error {
-	hasAnnotation := predicate.NewPredicateFuncs(func(o client.Object) bool {
-		val, ok := o.GetAnnotations()[vpaAnnotationKey]
-		return ok && val == "true"
-	})
-
-	return ctrl.NewControllerManagedBy(mgr).
-		Named("vpauto-"+getKind(obj)).
-		For(obj, builder.WithPredicates(hasAnnotation)).
-		Complete(r)
+	optedIn := func(o client.Object) bool {
+		keys := currentKeys(r.Config)
+		val, ok := o.GetAnnotations()[keys.VPAEnabled]
+		return ok && val == "true" || controllerutil.ContainsFinalizer(o, keys.RetainFinalizer) || len(r.previousRetainFinalizers(o)) > 0
+	}
+	prefix := func() string { return currentConfig(r.Config).AnnotationPrefix }
+
+	kind := getKind(obj)
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("vpauto-"+kind).
+		WithEventFilter(r.Namespaces.Predicate()).
+		WithOptions(controller.Options{RateLimiter: r.Backoff.rateLimiter()}).
+		For(obj, builder.OnlyMetadata, builder.WithPredicates(predicate.NewPredicateFuncs(optedIn), WorkloadChanges(kind, prefix, r.Metrics.FilteredWorkloadEvents)))
+	if r.CorrectDrift {
+		// Reconcile the workload again whenever the spec of its VPA is edited.
+		b = b.Owns(&autoscalingv1.VerticalPodAutoscaler{}, builder.WithPredicates(predicate.GenerationChangedPredicate{}))
+	}
+	if r.Config != nil {
+		// Apply a new configuration to the workloads it may affect. Raw sources
+		// bypass the event filters, so the workloads are filtered here.
+		b = b.WatchesRawSource(reloadSource(r.Config, mgr.GetClient(), kind, func(o client.Object) bool {
+			return r.Namespaces.Allows(o.GetNamespace()) && optedIn(o)
+		}))
+	}
+	return b.Complete(r)
 }
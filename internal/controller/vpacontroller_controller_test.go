@@ -2,25 +2,32 @@ package controller_test
 
 import (
 	"context"
+	"slices"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
 
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
 	"github.com/Sindvero/vpa-creation-operator/internal/controller"
 	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 func setupScheme(t *testing.T) *runtime.Scheme {
@@ -31,6 +38,33 @@ func setupScheme(t *testing.T) *runtime.Scheme {
 	return scheme
 }
 
+// newClientBuilder returns a fake client builder with the field indexes of the reconcilers.
+func newClientBuilder(scheme *runtime.Scheme) *fake.ClientBuilder {
+	return fake.NewClientBuilder().WithScheme(scheme).
+		WithIndex(&autoscalingv1.VerticalPodAutoscaler{}, controller.VPATargetRefIndex, controller.IndexVPATargetRef)
+}
+
+// applyAsMergePatch emulates server-side apply, which the fake client does not
+// support, with a create or a merge patch.
+var applyAsMergePatch = interceptor.Funcs{
+	Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+		if patch.Type() != types.ApplyPatchType {
+			return c.Patch(ctx, obj, patch, opts...)
+		}
+		data, err := patch.Data(obj)
+		if err != nil {
+			return err
+		}
+		existing := obj.DeepCopyObject().(client.Object)
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), existing); errors.IsNotFound(err) {
+			return c.Create(ctx, obj)
+		} else if err != nil {
+			return err
+		}
+		return c.Patch(ctx, obj, client.RawPatch(types.MergePatchType, data))
+	},
+}
+
 func TestReconcile_CreatesVPAForAnnotatedDeployment(t *testing.T) {
 	scheme := setupScheme(t)
 
@@ -49,18 +83,11 @@ func TestReconcile_CreatesVPAForAnnotatedDeployment(t *testing.T) {
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(dep).Build()
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
 	r := &controller.VPAControllerReconciler{
-		Client: fakeClient,
-		Scheme: scheme,
-		Metrics: &metrics.Collectors{
-			VPACreated: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_created"}, []string{"kind", "namespace"},
-			),
-			VPADeleted: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_deleted"}, []string{"namespace"},
-			),
-		},
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
 	}
 
 	res, err := r.Reconcile(context.TODO(), reconcile.Request{
@@ -74,6 +101,8 @@ func TestReconcile_CreatesVPAForAnnotatedDeployment(t *testing.T) {
 	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "test-deploy-vpa"}, &vpa)
 	assert.NoError(t, err)
 	assert.Equal(t, "test-deploy", vpa.Spec.TargetRef.Name)
+	assert.Equal(t, "vpauto-creation-controller", vpa.Labels["app.kubernetes.io/managed-by"])
+	assert.Contains(t, vpa.Annotations, "k8s.autoscaling.vpacreation/created-at")
 	assert.Equal(t, "Deployment", vpa.Spec.TargetRef.Kind)
 	assert.Equal(t, "apps/v1", vpa.Spec.TargetRef.APIVersion)
 	assert.Equal(t, autoscalingv1.UpdateModeOff, *vpa.Spec.UpdatePolicy.UpdateMode)
@@ -97,18 +126,11 @@ func TestReconcile_CreatesVPAForAnnotatedDaemonSet(t *testing.T) {
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(dep).Build()
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
 	r := &controller.VPAControllerReconciler{
-		Client: fakeClient,
-		Scheme: scheme,
-		Metrics: &metrics.Collectors{
-			VPACreated: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_created"}, []string{"kind", "namespace"},
-			),
-			VPADeleted: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_deleted"}, []string{"namespace"},
-			),
-		},
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
 	}
 
 	res, err := r.Reconcile(context.TODO(), reconcile.Request{
@@ -145,18 +167,11 @@ func TestReconcile_CreatesVPAForAnnotatedStatefulSet(t *testing.T) {
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(dep).Build()
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
 	r := &controller.VPAControllerReconciler{
-		Client: fakeClient,
-		Scheme: scheme,
-		Metrics: &metrics.Collectors{
-			VPACreated: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_created"}, []string{"kind", "namespace"},
-			),
-			VPADeleted: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_deleted"}, []string{"namespace"},
-			),
-		},
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
 	}
 
 	res, err := r.Reconcile(context.TODO(), reconcile.Request{
@@ -204,18 +219,11 @@ func TestReconcile_SkipsWithoutAnnotation(t *testing.T) {
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(dep).Build()
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
 	reconciler := &controller.VPAControllerReconciler{
-		Client: fakeClient,
-		Scheme: scheme,
-		Metrics: &metrics.Collectors{
-			VPACreated: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_created"}, []string{"kind", "namespace"},
-			),
-			VPADeleted: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_deleted"}, []string{"namespace"},
-			),
-		},
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
 	}
 
 	_, err := reconciler.Reconcile(context.TODO(), reconcile.Request{
@@ -262,18 +270,12 @@ func TestReconcile_ExistingVPA_NoDuplicate(t *testing.T) {
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(dep, existingVPA).Build()
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, existingVPA).WithInterceptorFuncs(applyAsMergePatch).Build()
 	reconciler := &controller.VPAControllerReconciler{
-		Client: fakeClient,
-		Scheme: scheme,
-		Metrics: &metrics.Collectors{
-			VPACreated: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_created"}, []string{"kind", "namespace"},
-			),
-			VPADeleted: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_deleted"}, []string{"namespace"},
-			),
-		},
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: record.NewFakeRecorder(10),
 	}
 
 	_, err := reconciler.Reconcile(context.TODO(), reconcile.Request{
@@ -287,37 +289,214 @@ func TestReconcile_ExistingVPA_NoDuplicate(t *testing.T) {
 	assert.Len(t, vpaList.Items, 1, "Should not create duplicate VPA")
 }
 
-func TestReconcile_OrphanedVPAIsDeleted(t *testing.T) {
+func TestReconcile_UsesRequestedUpdateMode(t *testing.T) {
 	scheme := setupScheme(t)
 
-	// Orphaned VPA (no owner reference)
-	orphaned := &autoscalingv1.VerticalPodAutoscaler{
+	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "orphaned-vpa",
+			Name:      "auto-deploy",
 			Namespace: "default",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+				"k8s.autoscaling.vpacreation/update-mode": "Auto",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "test"},
+			},
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(orphaned).Build()
-	reconciler := &controller.VPAControllerReconciler{
-		Client: fakeClient,
-		Scheme: scheme,
-		Metrics: &metrics.Collectors{
-			VPACreated: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_created"}, []string{"kind", "namespace"},
-			),
-			VPADeleted: prometheus.NewCounterVec(
-				prometheus.CounterOpts{Name: "test_deleted"}, []string{"namespace"},
-			),
-		},
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
 	}
 
-	_, err := reconciler.Reconcile(context.TODO(), reconcile.Request{})
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "auto-deploy"},
+	})
 	assert.NoError(t, err)
 
-	err = fakeClient.Get(context.TODO(), client.ObjectKey{
-		Namespace: "default",
-		Name:      "orphaned-vpa",
-	}, orphaned)
-	assert.True(t, errors.IsNotFound(err), "Orphaned VPA should have been deleted")
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "auto-deploy-vpa"}, &vpa)
+	assert.NoError(t, err)
+	assert.Equal(t, autoscalingv1.UpdateModeAuto, *vpa.Spec.UpdatePolicy.UpdateMode)
+}
+
+func TestReconcile_AppliesManagedVPA(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			UID:         "web-uid",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+		Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Annotations = map[string]string{"k8s.autoscaling.vpacreation/created-at": "2024-01-01T00:00:00Z"}
+	vpa.Spec.ResourcePolicy = &autoscalingv1.PodResourcePolicy{
+		ContainerPolicies: []autoscalingv1.ContainerResourcePolicy{{ContainerName: "app"}},
+	}
+
+	var patches []client.Patch
+	funcs := interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			patches = append(patches, patch)
+			return applyAsMergePatch.Patch(ctx, c, obj, patch, opts...)
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithInterceptorFuncs(funcs).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:  fakeClient,
+		Scheme:  scheme,
+		Metrics: metrics.NewCollectors(),
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, patches, 1)
+	assert.Equal(t, types.ApplyPatchType, patches[0].Type())
+
+	var got autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &got))
+	assert.Equal(t, "2024-01-01T00:00:00Z", got.Annotations["k8s.autoscaling.vpacreation/created-at"])
+	assert.Equal(t, "web", got.Spec.TargetRef.Name)
+	assert.NotNil(t, got.Spec.ResourcePolicy, "fields the controller does not set must be left alone")
+	assert.Equal(t, 0.0, testutil.ToFloat64(r.Metrics.VPACreated.WithLabelValues("Deployment", "default")))
+}
+
+func TestReconcile_ReportsApplyConflicts(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			UID:         "web-uid",
+			Annotations: map[string]string{"k8s.autoscaling.vpacreation/vpa-enabled": "true"},
+		},
+		Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeAuto)}
+
+	conflict := interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			return errors.NewApplyConflict([]metav1.StatusCause{{
+				Type:    metav1.CauseTypeFieldManagerConflict,
+				Message: `conflict with "kubectl-edit"`,
+				Field:   ".spec.updatePolicy.updateMode",
+			}}, `Apply failed with 1 conflict: conflict with "kubectl-edit": .spec.updatePolicy.updateMode`)
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithInterceptorFuncs(conflict).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: recorder,
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+	})
+	require.NoError(t, err)
+
+	var got autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &got))
+	assert.Equal(t, autoscalingv1.UpdateModeAuto, *got.Spec.UpdatePolicy.UpdateMode)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "VPAApplyConflict")
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPAApplyConflicts.WithLabelValues("Deployment", "default")))
+}
+
+func TestReconcile_TakesOverFieldsWrittenByController(t *testing.T) {
+	previous := annotations.KeysFor("autoscaling.example.com/")
+	tests := []struct {
+		name     string
+		manager  string
+		previous bool
+	}{
+		// The update mode was last written by a merge patch of the controller,
+		// such as the downgrade of the flapping protection.
+		{name: "merge patch", manager: `"vpauto-creation-controller" using autoscaling.k8s.io/v1`},
+		// The update mode was applied under the annotation prefix used before.
+		{name: "previous prefix", manager: `"` + previous.ManagedByValue + `"`, previous: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := setupScheme(t)
+
+			dep := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: "default",
+					UID:       "web-uid",
+					Annotations: map[string]string{
+						"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+						"k8s.autoscaling.vpacreation/update-mode": "Auto",
+					},
+				},
+				Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+			}
+			vpa := managedVPA("web-vpa", dep)
+			vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeInitial)}
+			cfg := config.Default()
+			if tt.previous {
+				cfg.PreviousAnnotationPrefixes = []string{previous.Prefix}
+				vpa.Labels[annotations.ManagedBy] = previous.ManagedByValue
+			}
+
+			var forced bool
+			funcs := interceptor.Funcs{
+				Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+					if patch.Type() == types.ApplyPatchType {
+						if !slices.Contains(opts, client.PatchOption(client.ForceOwnership)) {
+							msg := "conflict with " + tt.manager
+							return errors.NewApplyConflict([]metav1.StatusCause{{
+								Type:    metav1.CauseTypeFieldManagerConflict,
+								Message: msg,
+								Field:   ".spec.updatePolicy.updateMode",
+							}}, "Apply failed with 1 conflict: "+msg+": .spec.updatePolicy.updateMode")
+						}
+						forced = true
+					}
+					return applyAsMergePatch.Patch(ctx, c, obj, patch, opts...)
+				},
+			}
+			fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithInterceptorFuncs(funcs).Build()
+			recorder := record.NewFakeRecorder(10)
+			r := &controller.VPAControllerReconciler{
+				Client:   fakeClient,
+				Scheme:   scheme,
+				Metrics:  metrics.NewCollectors(),
+				Recorder: recorder,
+				Config:   config.NewStore(cfg),
+			}
+
+			_, err := r.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"},
+			})
+			require.NoError(t, err)
+
+			assert.True(t, forced)
+			var got autoscalingv1.VerticalPodAutoscaler
+			require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &got))
+			assert.Equal(t, autoscalingv1.UpdateModeAuto, *got.Spec.UpdatePolicy.UpdateMode)
+			assert.Equal(t, annotations.ManagedByValue, got.Labels[annotations.ManagedBy])
+			assert.Empty(t, recorder.Events)
+			assert.Equal(t, 0.0, testutil.ToFloat64(r.Metrics.VPAApplyConflicts.WithLabelValues("Deployment", "default")))
+		})
+	}
 }
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+// vpaConditionTypes are the VPA status conditions exported as metrics.
+var vpaConditionTypes = []autoscalingv1.VerticalPodAutoscalerConditionType{
+	autoscalingv1.RecommendationProvided,
+	autoscalingv1.LowConfidence,
+	autoscalingv1.NoPodsMatched,
+	autoscalingv1.FetchingHistory,
+	autoscalingv1.ConfigDeprecated,
+	autoscalingv1.ConfigUnsupported,
+}
+
+// VPAStatusReconciler watches the VPAs managed by the controller, exports their
+// status conditions as metrics and warns on the owning workload when a VPA stays
+// unusable for longer than RecommendationTimeout.
+type VPAStatusReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Metrics  *metrics.Collectors
+	Recorder record.EventRecorder
+	// RecommendationTimeout is how long a VPA may be ConfigUnsupported or without
+	// recommendation before a Warning event is emitted. Zero disables the events.
+	RecommendationTimeout time.Duration
+	// FlapCooldown is how long a VPA downgraded for eviction flapping stays in
+	// Initial mode. Zero only restores it on manual reset.
+	FlapCooldown time.Duration
+	// Namespaces restricts the namespaces the reconciler handles.
+	Namespaces NamespaceFilter
+	// Backoff bounds the retries of failed reconciles.
+	Backoff Backoff
+	// Config holds the configuration of the controller, reloaded on change.
+	// Defaults to config.Default().
+	Config *config.Store
+}
+
+func (r *VPAStatusReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	if err := r.Client.Get(ctx, req.NamespacedName, &vpa); err != nil {
+		if errors.IsNotFound(err) {
+			r.Metrics.VPACondition.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "vpa": req.Name})
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get VPA", "name", req.NamespacedName)
+		return ctrl.Result{}, err
+	}
+
+	for _, condType := range vpaConditionTypes {
+		value := 0.0
+		if c := findVPACondition(&vpa, condType); c != nil && c.Status == corev1.ConditionTrue {
+			value = 1
+		}
+		r.Metrics.VPACondition.WithLabelValues(vpa.Namespace, vpa.Name, string(condType)).Set(value)
+	}
+
+	if err := r.observeFirstRecommendation(ctx, &vpa); err != nil {
+		logger.Error(err, "Failed to record first recommendation", "name", vpa.Name)
+		return ctrl.Result{}, err
+	}
+
+	requeueAfter, err := restoreUpdateMode(ctx, r.Client, r.Recorder, &vpa, r.getOwner(ctx, &vpa), r.FlapCooldown, currentConfig(r.Config))
+	if err != nil {
+		logger.Error(err, "Failed to restore VPA update mode", "name", vpa.Name)
+		return ctrl.Result{}, err
+	}
+
+	if r.RecommendationTimeout <= 0 {
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	now := time.Now()
+	var reason, message string
+	var since time.Time
+	if c := findVPACondition(&vpa, autoscalingv1.ConfigUnsupported); c != nil && c.Status == corev1.ConditionTrue {
+		since = c.LastTransitionTime.Time
+		if since.IsZero() {
+			// The timeout starts once the transition is dated, which updates the VPA.
+			logger.V(1).Info("VPA is ConfigUnsupported without transition time, not timing it out yet", "name", vpa.Name)
+		} else if wait := r.RecommendationTimeout - now.Sub(since); wait > 0 {
+			requeueAfter = minRequeue(requeueAfter, wait)
+		} else {
+			reason = "VPAConfigUnsupported"
+			message = fmt.Sprintf("VPA %s has been ConfigUnsupported for more than %s: %s", vpa.Name, r.RecommendationTimeout, c.Message)
+		}
+	} else if !hasRecommendation(&vpa) {
+		since = vpa.CreationTimestamp.Time
+		if wait := r.RecommendationTimeout - now.Sub(since); wait > 0 {
+			requeueAfter = minRequeue(requeueAfter, wait)
+		} else {
+			reason = "VPANoRecommendation"
+			message = fmt.Sprintf("VPA %s has not provided a recommendation for more than %s", vpa.Name, r.RecommendationTimeout)
+		}
+	}
+
+	if err := r.warnTimeout(ctx, &vpa, reason, message, since); err != nil {
+		logger.Error(err, "Failed to record recommendation timeout", "name", vpa.Name)
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// warnTimeout emits a Warning event on the owning workload for the timeout of
+// the VPA started at since, once: the timeout is recorded on the VPA, and only
+// warned about again after the VPA recovers or its condition transitions anew.
+// An empty reason means the VPA is not timed out.
+func (r *VPAStatusReconciler) warnTimeout(ctx context.Context, vpa *autoscalingv1.VerticalPodAutoscaler, reason, message string, since time.Time) error {
+	keys := currentKeys(r.Config)
+	key := keys.TimeoutWarning
+	previous, warned := vpa.Annotations[key]
+	if reason == "" {
+		if !warned {
+			return nil
+		}
+		patch := client.MergeFrom(vpa.DeepCopy())
+		delete(vpa.Annotations, key)
+		return patchVPA(ctx, r.Client, vpa, patch, keys)
+	}
+
+	value := reason + "/" + since.UTC().Format(time.RFC3339)
+	if previous == value {
+		return nil
+	}
+	patch := client.MergeFrom(vpa.DeepCopy())
+	metav1.SetMetaDataAnnotation(&vpa.ObjectMeta, key, value)
+	if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+		return err
+	}
+	if owner := r.getOwner(ctx, vpa); owner != nil {
+		r.Recorder.Event(owner, corev1.EventTypeWarning, reason, message)
+	}
+	log.FromContext(ctx).Info("VPA is not providing recommendations", "name", vpa.Name, "reason", reason)
+	return nil
+}
+
+// observeFirstRecommendation observes the time between the creation of the VPA by the
+// controller and its first recommendation, and marks the VPA so it is only observed once.
+func (r *VPAStatusReconciler) observeFirstRecommendation(ctx context.Context, vpa *autoscalingv1.VerticalPodAutoscaler) error {
+	if !hasRecommendation(vpa) {
+		return nil
+	}
+	keys := currentKeys(r.Config)
+	if _, ok := vpa.Annotations[keys.FirstRecommendationAt]; ok {
+		return nil
+	}
+	createdAt, err := time.Parse(time.RFC3339, vpa.Annotations[keys.CreatedAt])
+	if err != nil {
+		// Not created by this version of the controller, nothing to measure.
+		return nil
+	}
+
+	now := time.Now()
+	patch := client.MergeFrom(vpa.DeepCopy())
+	vpa.Annotations[keys.FirstRecommendationAt] = now.UTC().Format(time.RFC3339)
+	if err := patchVPA(ctx, r.Client, vpa, patch, keys); err != nil {
+		return err
+	}
+
+	kind := "Unknown"
+	if vpa.Spec.TargetRef != nil {
+		kind = vpa.Spec.TargetRef.Kind
+	}
+	r.Metrics.TimeToFirstRecommendation.WithLabelValues(kind, vpa.Namespace).Observe(now.Sub(createdAt).Seconds())
+	return nil
+}
+
+// getOwner returns the workload controlling the VPA, or nil if it cannot be found.
+func (r *VPAStatusReconciler) getOwner(ctx context.Context, vpa *autoscalingv1.VerticalPodAutoscaler) client.Object {
+	ref := metav1.GetControllerOf(vpa)
+	if ref == nil {
+		return nil
+	}
+	owner, err := getWorkload(ctx, r.Client, ref.Kind, client.ObjectKey{Namespace: vpa.Namespace, Name: ref.Name})
+	if err != nil {
+		return nil
+	}
+	return owner
+}
+
+// minRequeue returns the shortest of two requeue delays, zero meaning no requeue.
+func minRequeue(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func findVPACondition(vpa *autoscalingv1.VerticalPodAutoscaler, condType autoscalingv1.VerticalPodAutoscalerConditionType) *autoscalingv1.VerticalPodAutoscalerCondition {
+	for i := range vpa.Status.Conditions {
+		if vpa.Status.Conditions[i].Type == condType {
+			return &vpa.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func hasRecommendation(vpa *autoscalingv1.VerticalPodAutoscaler) bool {
+	return vpa.Status.Recommendation != nil && len(vpa.Status.Recommendation.ContainerRecommendations) > 0
+}
+
+func (r *VPAStatusReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("vpauto-vpastatus").
+		WithEventFilter(r.Namespaces.Predicate()).
+		WithOptions(controller.Options{RateLimiter: r.Backoff.rateLimiter()}).
+		For(&autoscalingv1.VerticalPodAutoscaler{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return isManagedVPA(o, currentKeys(r.Config))
+		}))).
+		Complete(r)
+}
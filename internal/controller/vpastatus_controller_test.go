@@ -0,0 +1,335 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+func managedVPA(name string, owner *appsv1.Deployment) *autoscalingv1.VerticalPodAutoscaler {
+	return &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         owner.Namespace,
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-2 * time.Hour)),
+			Labels:            map[string]string{"app.kubernetes.io/managed-by": "vpauto-creation-controller"},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       owner.Name,
+				UID:        owner.UID,
+				Controller: ptr.To(true),
+			}},
+		},
+		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+			TargetRef: &autoscalingcorev1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: owner.Name},
+		},
+	}
+}
+
+func TestVPAStatus_ExportsConditions(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Status.Conditions = []autoscalingv1.VerticalPodAutoscalerCondition{
+		{Type: autoscalingv1.RecommendationProvided, Status: corev1.ConditionTrue},
+		{Type: autoscalingv1.LowConfidence, Status: corev1.ConditionFalse},
+	}
+	vpa.Status.Recommendation = &autoscalingv1.RecommendedPodResources{
+		ContainerRecommendations: []autoscalingv1.RecommendedContainerResources{{ContainerName: "app"}},
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAStatusReconciler{
+		Client:                fakeClient,
+		Scheme:                scheme,
+		Metrics:               metrics.NewCollectors(),
+		Recorder:              recorder,
+		RecommendationTimeout: time.Hour,
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.Metrics.VPACondition.WithLabelValues("default", "web-vpa", "RecommendationProvided")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(r.Metrics.VPACondition.WithLabelValues("default", "web-vpa", "LowConfidence")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(r.Metrics.VPACondition.WithLabelValues("default", "web-vpa", "ConfigUnsupported")))
+	assert.Empty(t, recorder.Events)
+
+	require.NoError(t, fakeClient.Delete(context.TODO(), vpa))
+	_, err = r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, testutil.CollectAndCount(r.Metrics.VPACondition), "series should be removed with the VPA")
+}
+
+func TestVPAStatus_WarnsOnConfigUnsupported(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Status.Conditions = []autoscalingv1.VerticalPodAutoscalerCondition{{
+		Type:               autoscalingv1.ConfigUnsupported,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour)),
+		Message:            "Unknown update mode",
+	}}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAStatusReconciler{
+		Client:                fakeClient,
+		Scheme:                scheme,
+		Metrics:               metrics.NewCollectors(),
+		Recorder:              recorder,
+		RecommendationTimeout: 30 * time.Minute,
+	}
+
+	res, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+	})
+	require.NoError(t, err)
+	assert.Zero(t, res.RequeueAfter)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning VPAConfigUnsupported")
+}
+
+func TestVPAStatus_WaitsForConfigUnsupportedTransitionTime(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Status.Conditions = []autoscalingv1.VerticalPodAutoscalerCondition{{
+		Type:    autoscalingv1.ConfigUnsupported,
+		Status:  corev1.ConditionTrue,
+		Message: "Unknown update mode",
+	}}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithStatusSubresource(vpa).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAStatusReconciler{
+		Client:                fakeClient,
+		Scheme:                scheme,
+		Metrics:               metrics.NewCollectors(),
+		Recorder:              recorder,
+		RecommendationTimeout: 30 * time.Minute,
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"}}
+
+	res, err := r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	assert.Zero(t, res.RequeueAfter)
+	assert.Empty(t, recorder.Events, "the timeout has not started without transition time")
+
+	var current autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(vpa), &current))
+	current.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-10 * time.Minute))
+	require.NoError(t, fakeClient.Status().Update(context.TODO(), &current))
+
+	res, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+	assert.InDelta(t, 20*time.Minute, res.RequeueAfter, float64(time.Minute))
+	assert.Empty(t, recorder.Events)
+}
+
+func TestVPAStatus_WarnsOncePerTransition(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Status.Conditions = []autoscalingv1.VerticalPodAutoscalerCondition{{
+		Type:               autoscalingv1.ConfigUnsupported,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour)),
+		Message:            "Unknown update mode",
+	}}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithStatusSubresource(vpa).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAStatusReconciler{
+		Client:                fakeClient,
+		Scheme:                scheme,
+		Metrics:               metrics.NewCollectors(),
+		Recorder:              recorder,
+		RecommendationTimeout: 30 * time.Minute,
+	}
+	reconcileVPA := func() {
+		t.Helper()
+		_, err := r.Reconcile(context.TODO(), reconcile.Request{
+			NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+		})
+		require.NoError(t, err)
+	}
+
+	reconcileVPA()
+	reconcileVPA()
+	require.Len(t, recorder.Events, 1, "status updates of the same timeout should not warn again")
+	assert.Contains(t, <-recorder.Events, "Warning VPAConfigUnsupported")
+
+	// The condition transitions anew: the new timeout is warned about.
+	var current autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(vpa), &current))
+	current.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-45 * time.Minute))
+	require.NoError(t, fakeClient.Status().Update(context.TODO(), &current))
+
+	reconcileVPA()
+	reconcileVPA()
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning VPAConfigUnsupported")
+}
+
+func TestVPAStatus_RequeuesBeforeTimeout(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.CreationTimestamp = metav1.NewTime(time.Now().Add(-10 * time.Minute))
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAStatusReconciler{
+		Client:                fakeClient,
+		Scheme:                scheme,
+		Metrics:               metrics.NewCollectors(),
+		Recorder:              recorder,
+		RecommendationTimeout: 30 * time.Minute,
+	}
+
+	res, err := r.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, recorder.Events)
+	assert.Greater(t, res.RequeueAfter, 15*time.Minute)
+	assert.LessOrEqual(t, res.RequeueAfter, 20*time.Minute)
+}
+
+func TestVPAStatus_ObservesFirstRecommendationOnce(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	vpa := managedVPA("web-vpa", dep)
+	vpa.Annotations = map[string]string{
+		"k8s.autoscaling.vpacreation/created-at": time.Now().Add(-5 * time.Minute).UTC().Format(time.RFC3339),
+	}
+	vpa.Spec.TargetRef = &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"}
+	vpa.Status.Recommendation = &autoscalingv1.RecommendedPodResources{
+		ContainerRecommendations: []autoscalingv1.RecommendedContainerResources{{ContainerName: "app"}},
+	}
+
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).Build()
+	r := &controller.VPAStatusReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := r.Reconcile(context.TODO(), reconcile.Request{
+			NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+		})
+		require.NoError(t, err)
+	}
+
+	var updated autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &updated))
+	assert.Contains(t, updated.Annotations, "k8s.autoscaling.vpacreation/first-recommendation-at")
+
+	var m dto.Metric
+	histogram := r.Metrics.TimeToFirstRecommendation.WithLabelValues("Deployment", "default").(prometheus.Histogram)
+	require.NoError(t, histogram.Write(&m))
+	assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount(), "first recommendation should be observed once")
+	assert.InDelta(t, 300, m.GetHistogram().GetSampleSum(), 5)
+}
+
+func TestVPAStatus_RestoresDowngradedUpdateMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		downgradedAt time.Time
+		reset        bool
+		workloadMode string
+		wantMode     autoscalingv1.UpdateMode
+	}{
+		{name: "within cool-down", downgradedAt: time.Now().Add(-time.Hour), wantMode: autoscalingv1.UpdateModeInitial},
+		{name: "after cool-down", downgradedAt: time.Now().Add(-7 * time.Hour), wantMode: autoscalingv1.UpdateModeRecreate},
+		{name: "manual reset", downgradedAt: time.Now().Add(-time.Hour), reset: true, wantMode: autoscalingv1.UpdateModeRecreate},
+		// The workload asked for another mode while the VPA was downgraded.
+		{name: "mode changed", downgradedAt: time.Now().Add(-7 * time.Hour), workloadMode: "Auto", wantMode: autoscalingv1.UpdateModeAuto},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := setupScheme(t)
+
+			mode := "Recreate"
+			if tt.workloadMode != "" {
+				mode = tt.workloadMode
+			}
+			dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+				Name:        "web",
+				Namespace:   "default",
+				UID:         "web-uid",
+				Annotations: map[string]string{"k8s.autoscaling.vpacreation/update-mode": mode},
+			}}
+			vpa := managedVPA("web-vpa", dep)
+			vpa.Spec.UpdatePolicy = &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeInitial)}
+			vpa.Annotations = map[string]string{
+				"k8s.autoscaling.vpacreation/downgraded-from":  "Recreate",
+				"k8s.autoscaling.vpacreation/downgraded-at":    tt.downgradedAt.UTC().Format(time.RFC3339),
+				"k8s.autoscaling.vpacreation/downgrade-reason": "5 evictions within 1h0m0s",
+			}
+			if tt.reset {
+				vpa.Annotations["k8s.autoscaling.vpacreation/reset-downgrade"] = "true"
+			}
+
+			fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).Build()
+			r := &controller.VPAStatusReconciler{
+				Client:       fakeClient,
+				Scheme:       scheme,
+				Metrics:      metrics.NewCollectors(),
+				Recorder:     record.NewFakeRecorder(10),
+				FlapCooldown: 6 * time.Hour,
+			}
+
+			res, err := r.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: client.ObjectKey{Namespace: "default", Name: "web-vpa"},
+			})
+			require.NoError(t, err)
+
+			var updated autoscalingv1.VerticalPodAutoscaler
+			require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &updated))
+			assert.Equal(t, tt.wantMode, *updated.Spec.UpdatePolicy.UpdateMode)
+			if tt.wantMode == autoscalingv1.UpdateModeInitial {
+				assert.Greater(t, res.RequeueAfter, 4*time.Hour)
+				assert.Contains(t, updated.Annotations, "k8s.autoscaling.vpacreation/downgraded-from")
+			} else {
+				assert.NotContains(t, updated.Annotations, "k8s.autoscaling.vpacreation/downgraded-from")
+				assert.NotContains(t, updated.Annotations, "k8s.autoscaling.vpacreation/reset-downgrade")
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+)
+
+// workloadConfig returns the document of the config annotation of the workload,
+// nil without annotation, or the errors of an invalid one.
+func workloadConfig(obj client.Object, keys annotations.Keys) (*annotations.WorkloadConfig, field.ErrorList) {
+	value, ok := obj.GetAnnotations()[keys.Config]
+	if !ok {
+		return nil, nil
+	}
+	return annotations.ParseConfig(field.NewPath("metadata", "annotations").Key(keys.Config), value)
+}
+
+// configHash returns a short hash of the value of a config annotation.
+func configHash(value string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// applyWorkloadConfig sets the recommenders and container policies of the VPA
+// from the parsed config annotation of the workload, and records the annotation
+// on the VPA so its removal is noticed. The update mode is set by updateModeFor.
+func applyWorkloadConfig(vpa *autoscalingv1.VerticalPodAutoscaler, obj client.Object, wc *annotations.WorkloadConfig, cfg *config.Configuration) {
+	if wc == nil {
+		return
+	}
+	keys := cfg.Keys()
+
+	if wc.Profile != "" {
+		for _, name := range cfg.Recommenders(wc.Profile) {
+			vpa.Spec.Recommenders = append(vpa.Spec.Recommenders, &autoscalingv1.VerticalPodAutoscalerRecommenderSelector{Name: name})
+		}
+	}
+	for _, c := range wc.Containers {
+		p := containerPolicy(vpa, c.Name)
+		if c.Mode != "" {
+			mode := autoscalingv1.ContainerScalingMode(c.Mode)
+			p.Mode = &mode
+		}
+		p.MinAllowed = c.MinAllowed.DeepCopy()
+		p.MaxAllowed = c.MaxAllowed.DeepCopy()
+		if len(c.ControlledResources) > 0 {
+			resources := append([]corev1.ResourceName(nil), c.ControlledResources...)
+			p.ControlledResources = &resources
+		}
+		if c.ControlledValues != "" {
+			values := autoscalingv1.ContainerControlledValues(c.ControlledValues)
+			p.ControlledValues = &values
+		}
+	}
+	if vpa.Annotations == nil {
+		vpa.Annotations = map[string]string{}
+	}
+	vpa.Annotations[keys.Config] = obj.GetAnnotations()[keys.Config]
+}
+
+// configured reports whether the VPA is, or was last applied, configured by the
+// config annotation of its workload, in which case its container policies and
+// recommenders are set by the controller.
+func configured(vpa *autoscalingv1.VerticalPodAutoscaler, keys annotations.Keys) bool {
+	_, ok := vpa.Annotations[keys.Config]
+	return ok
+}
@@ -0,0 +1,252 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingcorev1 "k8s.io/api/autoscaling/v1"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/config"
+	"github.com/Sindvero/vpa-creation-operator/internal/controller"
+	"github.com/Sindvero/vpa-creation-operator/internal/metrics"
+)
+
+const workloadConfig = `
+apiVersion: vpacreation.com/v1alpha1
+kind: VPAConfig
+updateMode: Auto
+profile: frugal
+containers:
+  - name: app
+    minAllowed: {cpu: 100m, memory: 128Mi}
+    maxAllowed: {memory: 1Gi}
+    controlledResources: [memory]
+    controlledValues: RequestsOnly
+  - name: sidecar
+    mode: "Off"
+`
+
+func TestReconcile_AppliesConfigAnnotation(t *testing.T) {
+	scheme := setupScheme(t)
+
+	cfg := config.Default()
+	cfg.Profiles = map[string][]string{"frugal": {"frugal-recommender"}}
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+				"k8s.autoscaling.vpacreation/update-mode": "Initial",
+				"k8s.autoscaling.vpacreation/config":      workloadConfig,
+			},
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:       fakeClient,
+		Scheme:       scheme,
+		Metrics:      metrics.NewCollectors(),
+		Recorder:     record.NewFakeRecorder(10),
+		CorrectDrift: true,
+		Config:       config.NewStore(cfg),
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}}
+
+	_, err := r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &vpa))
+	assert.Equal(t, autoscalingv1.UpdateModeAuto, *vpa.Spec.UpdatePolicy.UpdateMode, "the config annotation takes precedence")
+	require.Len(t, vpa.Spec.Recommenders, 1)
+	assert.Equal(t, "frugal-recommender", vpa.Spec.Recommenders[0].Name)
+
+	requestsOnly := autoscalingv1.ContainerControlledValuesRequestsOnly
+	off := autoscalingv1.ContainerScalingModeOff
+	require.NotNil(t, vpa.Spec.ResourcePolicy)
+	assert.Equal(t, []autoscalingv1.ContainerResourcePolicy{
+		{
+			ContainerName: "app",
+			MinAllowed: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+			MaxAllowed:          corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			ControlledResources: &[]corev1.ResourceName{corev1.ResourceMemory},
+			ControlledValues:    &requestsOnly,
+		},
+		{ContainerName: "sidecar", Mode: &off},
+	}, vpa.Spec.ResourcePolicy.ContainerPolicies)
+
+	// Manual edits of the configured fields are reverted.
+	vpa.Spec.Recommenders = []*autoscalingv1.VerticalPodAutoscalerRecommenderSelector{{Name: "other"}}
+	vpa.Spec.ResourcePolicy.ContainerPolicies = vpa.Spec.ResourcePolicy.ContainerPolicies[:1]
+	require.NoError(t, fakeClient.Update(context.TODO(), &vpa))
+
+	_, err = r.Reconcile(context.TODO(), req)
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &vpa))
+	require.Len(t, vpa.Spec.Recommenders, 1)
+	assert.Equal(t, "frugal-recommender", vpa.Spec.Recommenders[0].Name)
+	assert.Len(t, vpa.Spec.ResourcePolicy.ContainerPolicies, 2)
+}
+
+func TestReconcile_IgnoresInvalidConfigAnnotation(t *testing.T) {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+				"k8s.autoscaling.vpacreation/update-mode": "Initial",
+				"k8s.autoscaling.vpacreation/config":      "apiVersion: vpacreation.com/v1alpha1\nkind: VPAConfig\nupdateMode: Always\n",
+			},
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep).WithInterceptorFuncs(applyAsMergePatch).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: recorder,
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+
+	var vpa autoscalingv1.VerticalPodAutoscaler
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "web-vpa"}, &vpa))
+	assert.Equal(t, autoscalingv1.UpdateModeInitial, *vpa.Spec.UpdatePolicy.UpdateMode)
+	assert.Nil(t, vpa.Spec.ResourcePolicy)
+	assert.NotContains(t, vpa.Annotations, "k8s.autoscaling.vpacreation/config")
+
+	require.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "InvalidVPAConfig")
+	assert.Contains(t, event, `metadata.annotations[k8s.autoscaling.vpacreation/config].updateMode: Unsupported value: "Always"`)
+
+	// The same invalid value is only warned about once.
+	_, err = r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+	assert.Empty(t, recorder.Events)
+
+	// Another invalid value is warned about again.
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(dep), dep))
+	dep.Annotations["k8s.autoscaling.vpacreation/config"] = "apiVersion: vpacreation.com/v1alpha1\nkind: VPAConfig\nupdateMode: Never\n"
+	require.NoError(t, fakeClient.Update(context.TODO(), dep))
+
+	_, err = r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, `Unsupported value: "Never"`)
+}
+
+// reconcileConfiguredVPA reconciles a workload with the config annotation whose
+// VPA was last applied with the previous config annotation, and returns the
+// container policies of the VPA.
+func reconcileConfiguredVPA(t *testing.T, previous, current string, vpaAnnotations map[string]string, minAllowed corev1.ResourceList) []autoscalingv1.ContainerResourcePolicy {
+	scheme := setupScheme(t)
+
+	dep := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			UID:       "web-uid",
+			Annotations: map[string]string{
+				"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+				"k8s.autoscaling.vpacreation/config":      current,
+			},
+		},
+	}
+	vpaAnnotations["k8s.autoscaling.vpacreation/config"] = previous
+	vpaAnnotations["k8s.autoscaling.vpacreation/created-at"] = "2024-01-01T00:00:00Z"
+	vpa := &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-vpa",
+			Namespace:       "default",
+			Labels:          map[string]string{"app.kubernetes.io/managed-by": "vpauto-creation-controller"},
+			Annotations:     vpaAnnotations,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(dep, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+		},
+		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+			TargetRef: &autoscalingcorev1.CrossVersionObjectReference{Kind: "Deployment", Name: "web", APIVersion: "apps/v1"},
+			ResourcePolicy: &autoscalingv1.PodResourcePolicy{ContainerPolicies: []autoscalingv1.ContainerResourcePolicy{
+				{ContainerName: "app", MinAllowed: minAllowed},
+			}},
+		},
+	}
+	fakeClient := newClientBuilder(scheme).WithObjects(dep, vpa).WithInterceptorFuncs(applyAsMergePatch).Build()
+	r := &controller.VPAControllerReconciler{
+		Client:   fakeClient,
+		Scheme:   scheme,
+		Metrics:  metrics.NewCollectors(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	_, err := r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "web"}})
+	require.NoError(t, err)
+
+	require.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(vpa), vpa))
+	require.NotNil(t, vpa.Spec.ResourcePolicy)
+	return vpa.Spec.ResourcePolicy.ContainerPolicies
+}
+
+func configWithMinAllowed(minAllowed, maxAllowed string) string {
+	return `{"apiVersion": "vpacreation.com/v1alpha1", "kind": "VPAConfig", "containers": [` +
+		`{"name": "app", "minAllowed": ` + minAllowed + `, "maxAllowed": ` + maxAllowed + `}]}`
+}
+
+func TestReconcile_MergesInheritedFloorsWithConfigAnnotation(t *testing.T) {
+	policies := reconcileConfiguredVPA(t,
+		configWithMinAllowed(`{"cpu": "100m", "memory": "512Mi"}`, `{}`),
+		configWithMinAllowed(`{"cpu": "200m", "memory": "256Mi"}`, `{}`),
+		map[string]string{"k8s.autoscaling.vpacreation/inherited-from": "checkout-blue-vpa"},
+		corev1.ResourceList{
+			// Inherited above the configured cpu, configured memory.
+			corev1.ResourceCPU:    resource.MustParse("500m"),
+			corev1.ResourceMemory: resource.MustParse("512Mi"),
+		},
+	)
+
+	require.Len(t, policies, 1)
+	assert.Equal(t, corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("500m"),
+		corev1.ResourceMemory: resource.MustParse("256Mi"),
+	}, policies[0].MinAllowed, "the inherited cpu floor is kept, the lowered memory minAllowed applies")
+}
+
+func TestReconcile_MergesOOMFloorWithConfigAnnotation(t *testing.T) {
+	policies := reconcileConfiguredVPA(t,
+		configWithMinAllowed(`{"cpu": "100m", "memory": "128Mi"}`, `{"memory": "2Gi"}`),
+		configWithMinAllowed(`{"cpu": "250m", "memory": "128Mi"}`, `{"memory": "2Gi"}`),
+		map[string]string{"k8s.autoscaling.vpacreation/last-oom-bump-at": "2024-01-02T00:00:00Z"},
+		corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("3Gi"),
+		},
+	)
+
+	require.Len(t, policies, 1)
+	assert.Equal(t, corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("250m"),
+		corev1.ResourceMemory: resource.MustParse("2Gi"),
+	}, policies[0].MinAllowed, "the configured cpu applies, the memory floor is capped by maxAllowed")
+}
@@ -5,8 +5,18 @@ import (
 )
 
 type Collectors struct {
-	VPACreated *prometheus.CounterVec
-	VPADeleted *prometheus.CounterVec
+	VPACreated   *prometheus.CounterVec
+	VPADeleted   *prometheus.CounterVec
+	VPACondition *prometheus.GaugeVec
+
+	TimeToFirstRecommendation *prometheus.HistogramVec
+	VPAEvictions              *prometheus.CounterVec
+	OOMMemoryFloorRaised      *prometheus.CounterVec
+	VPADriftReverted          *prometheus.CounterVec
+	VPAApplyConflicts         *prometheus.CounterVec
+	VPANameConflict           *prometheus.GaugeVec
+	DryRunActions             *prometheus.CounterVec
+	FilteredWorkloadEvents    *prometheus.CounterVec
 }
 
 func NewCollectors() *Collectors {
@@ -25,11 +35,77 @@ func NewCollectors() *Collectors {
 			},
 			[]string{"namespace"},
 		),
+		VPACondition: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vpactrl_vpa_condition",
+				Help: "Status conditions of the VPAs managed by the controller (1 if the condition is true, 0 otherwise)",
+			},
+			[]string{"namespace", "vpa", "condition"},
+		),
+		TimeToFirstRecommendation: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "vpactrl_time_to_first_recommendation_seconds",
+				Help:    "Time between the creation of a VPA by the controller and its first recommendation",
+				Buckets: prometheus.ExponentialBuckets(60, 2, 10),
+			},
+			[]string{"kind", "namespace"},
+		),
+		VPAEvictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vpactrl_vpa_evictions_total",
+				Help: "Number of pods evicted by the VPA updater, per workload",
+			},
+			[]string{"kind", "namespace", "name"},
+		),
+		OOMMemoryFloorRaised: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vpactrl_oom_memory_floor_raised_total",
+				Help: "Number of times the memory minAllowed of a managed VPA was raised after an OOM kill",
+			},
+			[]string{"kind", "namespace", "name", "container"},
+		),
+		VPADriftReverted: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vpactrl_vpa_drift_reverted_total",
+				Help: "Number of manual edits of a managed VPA spec field reverted by the controller",
+			},
+			[]string{"kind", "namespace", "field"},
+		),
+		VPAApplyConflicts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vpactrl_vpa_apply_conflicts_total",
+				Help: "Number of applies of a managed VPA not performed because its fields are owned by another manager",
+			},
+			[]string{"kind", "namespace"},
+		),
+		VPANameConflict: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vpactrl_vpa_name_conflict",
+				Help: "Opted-in workloads whose VPA cannot be created because its name is taken by a VPA of another workload",
+			},
+			[]string{"kind", "namespace", "name"},
+		),
+		DryRunActions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vpactrl_dry_run_actions_total",
+				Help: "Number of mutating calls the controller would have made, in dry-run mode",
+			},
+			[]string{"verb", "kind", "namespace"},
+		),
+		FilteredWorkloadEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vpactrl_filtered_workload_events_total",
+				Help: "Number of workload updates ignored by the controller because they cannot change the VPA",
+			},
+			[]string{"kind"},
+		),
 	}
 }
 
 func SetupMetrics() *Collectors {
 	c := NewCollectors()
-	prometheus.MustRegister(c.VPACreated, c.VPADeleted)
+	prometheus.MustRegister(c.VPACreated, c.VPADeleted, c.VPACondition, c.TimeToFirstRecommendation,
+		c.VPAEvictions, c.OOMMemoryFloorRaised, c.VPADriftReverted,
+		c.VPAApplyConflicts, c.VPANameConflict, c.DryRunActions, c.FilteredWorkloadEvents)
 	return c
 }
@@ -0,0 +1,102 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// +kubebuilder:webhook:path=/validate-vpacreation-vpa,mutating=false,failurePolicy=ignore,sideEffects=None,groups=autoscaling.k8s.io,resources=verticalpodautoscalers,verbs=update,versions=v1,name=vvpa.vpacreation.com,admissionReviewVersions=v1
+
+// VPAGuardPath is the path the managed VPA guard is served on.
+const VPAGuardPath = "/validate-vpacreation-vpa"
+
+// VPAGuard rejects manual edits of the VPAs managed by the controller. Changes to
+// their spec or managed-by label are only allowed from the controller itself, or
+// when the VPA carries the k8s.autoscaling.vpacreation/allow-manual-edit annotation.
+// The VPAs of other instances of the controller, using another annotation prefix,
+// are left to them.
+type VPAGuard struct {
+	// ControllerUsername is the user the controller authenticates as.
+	ControllerUsername string
+	// Keys are the annotations of the controller. Defaults to annotations.DefaultKeys.
+	Keys annotations.Keys
+}
+
+func (g *VPAGuard) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := log.FromContext(ctx)
+
+	if req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+
+	var oldVPA, newVPA autoscalingv1.VerticalPodAutoscaler
+	if err := json.Unmarshal(req.OldObject.Raw, &oldVPA); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := json.Unmarshal(req.Object.Raw, &newVPA); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	keys := keysOrDefault(g.Keys)
+	if oldVPA.Labels[annotations.ManagedBy] != keys.ManagedByValue {
+		return admission.Allowed("")
+	}
+	if req.UserInfo.Username == g.ControllerUsername {
+		return admission.Allowed("")
+	}
+	if newVPA.Annotations[keys.AllowManualEdit] == "true" {
+		return admission.Allowed("manual edit allowed by annotation")
+	}
+	if equality.Semantic.DeepEqual(oldVPA.Spec, newVPA.Spec) &&
+		newVPA.Labels[annotations.ManagedBy] == keys.ManagedByValue {
+		return admission.Allowed("")
+	}
+
+	logger.Info("Rejected manual edit of managed VPA", "namespace", req.Namespace, "name", req.Name, "user", req.UserInfo.Username)
+	return admission.Denied(fmt.Sprintf("VPA %s is managed by %s and changes to it would be lost; configure it through the "+
+		"annotations of its workload, or set the %s: \"true\" annotation on the VPA to edit it anyway",
+		req.Name, keys.ManagedByValue, keys.AllowManualEdit))
+}
+
+// ServiceAccountUsername returns the username of the service account the token
+// at tokenPath belongs to, e.g. system:serviceaccount:<namespace>:<name>.
+func ServiceAccountUsername(tokenPath string) (string, error) {
+	token, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed service account token %s", tokenPath)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed service account token %s: %w", tokenPath, err)
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("malformed service account token %s: %w", tokenPath, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("service account token %s has no subject", tokenPath)
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,132 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	autoscalingv1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/webhooks"
+)
+
+const controllerUser = "system:serviceaccount:vpa-creation-operator-system:vpa-creation-operator-controller-manager"
+
+func vpaUpdateRequest(t *testing.T, user string, oldVPA, newVPA *autoscalingv1.VerticalPodAutoscaler) admission.Request {
+	oldRaw, err := json.Marshal(oldVPA)
+	require.NoError(t, err)
+	newRaw, err := json.Marshal(newVPA)
+	require.NoError(t, err)
+
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Update,
+		Namespace: "default",
+		Name:      oldVPA.Name,
+		UserInfo:  authenticationv1.UserInfo{Username: user},
+		OldObject: runtime.RawExtension{Raw: oldRaw},
+		Object:    runtime.RawExtension{Raw: newRaw},
+	}}
+}
+
+func guardedVPA() *autoscalingv1.VerticalPodAutoscaler {
+	return &autoscalingv1.VerticalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-vpa",
+			Namespace: "default",
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "vpauto-creation-controller"},
+		},
+		Spec: autoscalingv1.VerticalPodAutoscalerSpec{
+			UpdatePolicy: &autoscalingv1.PodUpdatePolicy{UpdateMode: ptr.To(autoscalingv1.UpdateModeOff)},
+		},
+	}
+}
+
+func TestVPAGuard(t *testing.T) {
+	g := &webhooks.VPAGuard{ControllerUsername: controllerUser}
+
+	edited := guardedVPA()
+	edited.Spec.UpdatePolicy.UpdateMode = ptr.To(autoscalingv1.UpdateModeAuto)
+
+	overridden := edited.DeepCopy()
+	overridden.Annotations = map[string]string{"k8s.autoscaling.vpacreation/allow-manual-edit": "true"}
+
+	unmarked := guardedVPA()
+	unmarked.Labels = nil
+
+	annotated := guardedVPA()
+	annotated.Annotations = map[string]string{"note": "metadata only"}
+
+	unmanaged := guardedVPA()
+	unmanaged.Labels = nil
+	unmanagedEdited := edited.DeepCopy()
+	unmanagedEdited.Labels = nil
+
+	tests := []struct {
+		name    string
+		user    string
+		oldVPA  *autoscalingv1.VerticalPodAutoscaler
+		newVPA  *autoscalingv1.VerticalPodAutoscaler
+		allowed bool
+	}{
+		{name: "manual spec edit", user: "alice", oldVPA: guardedVPA(), newVPA: edited, allowed: false},
+		{name: "manual removal of the marker", user: "alice", oldVPA: guardedVPA(), newVPA: unmarked, allowed: false},
+		{name: "controller edit", user: controllerUser, oldVPA: guardedVPA(), newVPA: edited, allowed: true},
+		{name: "override annotation", user: "alice", oldVPA: guardedVPA(), newVPA: overridden, allowed: true},
+		{name: "metadata only", user: "alice", oldVPA: guardedVPA(), newVPA: annotated, allowed: true},
+		{name: "unmanaged VPA", user: "alice", oldVPA: unmanaged, newVPA: unmanagedEdited, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := g.Handle(context.TODO(), vpaUpdateRequest(t, tt.user, tt.oldVPA, tt.newVPA))
+			assert.Equal(t, tt.allowed, res.Allowed)
+			if !tt.allowed {
+				assert.Contains(t, res.Result.Message, "k8s.autoscaling.vpacreation/allow-manual-edit")
+			}
+		})
+	}
+}
+
+func TestVPAGuard_LeavesOtherInstancesAlone(t *testing.T) {
+	keys := annotations.KeysFor("autoscaling.example.com/")
+	g := &webhooks.VPAGuard{ControllerUsername: controllerUser, Keys: keys}
+
+	edited := guardedVPA()
+	edited.Spec.UpdatePolicy.UpdateMode = ptr.To(autoscalingv1.UpdateModeAuto)
+	res := g.Handle(context.TODO(), vpaUpdateRequest(t, "alice", guardedVPA(), edited))
+	assert.True(t, res.Allowed, "VPA of the instance with the default prefix")
+
+	owned := guardedVPA()
+	owned.Labels["app.kubernetes.io/managed-by"] = keys.ManagedByValue
+	ownedEdited := owned.DeepCopy()
+	ownedEdited.Spec.UpdatePolicy.UpdateMode = ptr.To(autoscalingv1.UpdateModeAuto)
+	res = g.Handle(context.TODO(), vpaUpdateRequest(t, "alice", owned, ownedEdited))
+	assert.False(t, res.Allowed)
+	assert.Contains(t, res.Result.Message, "autoscaling.example.com/allow-manual-edit")
+}
+
+func TestServiceAccountUsername(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + controllerUser + `"}`))
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("header."+payload+".signature\n"), 0o600))
+
+	username, err := webhooks.ServiceAccountUsername(path)
+	require.NoError(t, err)
+	assert.Equal(t, controllerUser, username)
+
+	require.NoError(t, os.WriteFile(path, []byte("not-a-token"), 0o600))
+	_, err = webhooks.ServiceAccountUsername(path)
+	assert.Error(t, err)
+}
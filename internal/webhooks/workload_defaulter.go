@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// +kubebuilder:webhook:path=/mutate-vpacreation-workload,mutating=true,failurePolicy=ignore,sideEffects=None,groups=apps,resources=deployments;daemonsets;statefulsets,verbs=create,versions=v1,name=mworkload.vpacreation.com,admissionReviewVersions=v1
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// WorkloadDefaulterPath is the path the workload defaulter is served on.
+const WorkloadDefaulterPath = "/mutate-vpacreation-workload"
+
+// WorkloadDefaulter opts new Deployments, DaemonSets and StatefulSets in when
+// their namespace is labelled with k8s.autoscaling.vpacreation/default-opt-in,
+// so the annotation shows up explicitly in the workload. The annotations and
+// labels are the ones under the prefix of Keys.
+type WorkloadDefaulter struct {
+	Client client.Reader
+	// Keys are the annotations of the controller. Defaults to annotations.DefaultKeys.
+	Keys annotations.Keys
+}
+
+func (d *WorkloadDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := log.FromContext(ctx)
+
+	if req.Operation != admissionv1.Create {
+		return admission.Allowed("")
+	}
+
+	var obj unstructured.Unstructured
+	if err := json.Unmarshal(req.Object.Raw, &obj.Object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	keys := keysOrDefault(d.Keys)
+	current := obj.GetAnnotations()
+	if current[keys.OptOut] == "true" {
+		return admission.Allowed("workload opted out")
+	}
+	if _, ok := current[keys.VPAEnabled]; ok {
+		return admission.Allowed("workload already configured")
+	}
+
+	var ns corev1.Namespace
+	if err := d.Client.Get(ctx, client.ObjectKey{Name: req.Namespace}, &ns); err != nil {
+		logger.Error(err, "Failed to get namespace", "namespace", req.Namespace)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if ns.Labels[keys.DefaultOptIn] != "true" {
+		return admission.Allowed("")
+	}
+
+	defaulted := map[string]string{}
+	for k, v := range current {
+		defaulted[k] = v
+	}
+	defaulted[keys.VPAEnabled] = "true"
+	var warnings []string
+	if mode, ok := ns.Labels[keys.DefaultUpdateMode]; ok {
+		if _, set := defaulted[keys.UpdateMode]; !set {
+			// An invalid namespace default is not copied to the workload, which
+			// would then be rejected by the workload validator.
+			if slices.Contains(annotations.UpdateModes, mode) {
+				defaulted[keys.UpdateMode] = mode
+			} else {
+				logger.Info("Ignoring invalid default update mode of namespace", "namespace", req.Namespace, "mode", mode)
+				warnings = append(warnings, fmt.Sprintf("ignoring the %s label of namespace %s: unsupported update mode %q, must be one of %s",
+					keys.DefaultUpdateMode, req.Namespace, mode, strings.Join(annotations.UpdateModes, ", ")))
+			}
+		}
+	}
+	obj.SetAnnotations(defaulted)
+
+	raw, err := json.Marshal(obj.Object)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	logger.Info("Opting workload in from namespace defaults", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", obj.GetName())
+	return admission.PatchResponseFromRaw(req.Object.Raw, raw).WithWarnings(warnings...)
+}
@@ -0,0 +1,95 @@
+package webhooks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/webhooks"
+)
+
+func newDefaulter(t *testing.T, nsLabels map[string]string) *webhooks.WorkloadDefaulter {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: nsLabels}}
+	return &webhooks.WorkloadDefaulter{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ns).Build(),
+	}
+}
+
+func TestWorkloadDefaulter_OptsInFromNamespaceLabels(t *testing.T) {
+	d := newDefaulter(t, map[string]string{
+		"k8s.autoscaling.vpacreation/default-opt-in":      "true",
+		"k8s.autoscaling.vpacreation/default-update-mode": "Initial",
+	})
+
+	res := d.Handle(context.TODO(), workloadRequest(t, nil))
+
+	require.True(t, res.Allowed)
+	paths := map[string]interface{}{}
+	for _, p := range res.Patches {
+		paths[p.Path] = p.Value
+	}
+	assert.Equal(t, map[string]interface{}{
+		"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+		"k8s.autoscaling.vpacreation/update-mode": "Initial",
+	}, paths["/metadata/annotations"])
+}
+
+func TestWorkloadDefaulter_IgnoresInvalidDefaultUpdateMode(t *testing.T) {
+	d := newDefaulter(t, map[string]string{
+		"k8s.autoscaling.vpacreation/default-opt-in":      "true",
+		"k8s.autoscaling.vpacreation/default-update-mode": "Always",
+	})
+
+	res := d.Handle(context.TODO(), workloadRequest(t, nil))
+
+	require.True(t, res.Allowed)
+	paths := map[string]interface{}{}
+	for _, p := range res.Patches {
+		paths[p.Path] = p.Value
+	}
+	assert.Equal(t, map[string]interface{}{
+		"k8s.autoscaling.vpacreation/vpa-enabled": "true",
+	}, paths["/metadata/annotations"])
+	require.Len(t, res.Warnings, 1)
+	assert.Contains(t, res.Warnings[0], `unsupported update mode "Always"`)
+}
+
+func TestWorkloadDefaulter_KeepsExplicitConfiguration(t *testing.T) {
+	d := newDefaulter(t, map[string]string{"k8s.autoscaling.vpacreation/default-opt-in": "true"})
+
+	tests := map[string]map[string]string{
+		"opted out":      {"k8s.autoscaling.vpacreation/opt-out": "true"},
+		"explicitly off": {"k8s.autoscaling.vpacreation/vpa-enabled": "false"},
+	}
+	for name, annotations := range tests {
+		t.Run(name, func(t *testing.T) {
+			res := d.Handle(context.TODO(), workloadRequest(t, annotations))
+			assert.True(t, res.Allowed)
+			assert.Empty(t, res.Patches)
+		})
+	}
+}
+
+func TestWorkloadDefaulter_IgnoresUnlabelledNamespaces(t *testing.T) {
+	d := newDefaulter(t, nil)
+
+	res := d.Handle(context.TODO(), workloadRequest(t, nil))
+	assert.True(t, res.Allowed)
+	assert.Empty(t, res.Patches)
+
+	req := workloadRequest(t, nil)
+	req.Operation = admissionv1.Update
+	res = d.Handle(context.TODO(), req)
+	assert.True(t, res.Allowed)
+	assert.Empty(t, res.Patches)
+}
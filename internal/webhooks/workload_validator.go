@@ -0,0 +1,127 @@
+// Package webhooks implements the admission webhooks served by the controller.
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+)
+
+// +kubebuilder:webhook:path=/validate-vpacreation-workload,mutating=false,failurePolicy=ignore,sideEffects=None,groups=apps,resources=deployments;daemonsets;statefulsets,verbs=create;update,versions=v1,name=vworkload.vpacreation.com,admissionReviewVersions=v1
+
+// WorkloadValidatorPath is the path the workload annotation validator is served on.
+const WorkloadValidatorPath = "/validate-vpacreation-workload"
+
+// WorkloadValidator rejects Deployments, DaemonSets and StatefulSets carrying
+// malformed k8s.autoscaling.vpacreation/* annotations, or annotations under the
+// prefix of Keys. On update, only the annotations added or changed are
+// validated, and workloads being deleted or having their finalizers removed are
+// always admitted.
+type WorkloadValidator struct {
+	// WarnOnly admits the workload with a warning instead of rejecting it.
+	WarnOnly bool
+	// Keys are the annotations of the controller. Defaults to annotations.DefaultKeys.
+	Keys annotations.Keys
+}
+
+func (v *WorkloadValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := log.FromContext(ctx)
+
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+
+	// Only the metadata is needed to validate the annotations.
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	annots := obj.Annotations
+	if req.Operation == admissionv1.Update {
+		if obj.DeletionTimestamp != nil || onlyRemovesFinalizers(req.OldObject.Raw, req.Object.Raw) {
+			return admission.Allowed("")
+		}
+		var old metav1.PartialObjectMetadata
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		annots = changedAnnotations(old.Annotations, obj.Annotations)
+	}
+
+	errs := keysOrDefault(v.Keys).Validate(annots)
+	if len(errs) == 0 {
+		return admission.Allowed("")
+	}
+
+	logger.Info("Malformed VPA annotations", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "errors", errs.ToAggregate().Error())
+	if v.WarnOnly {
+		warnings := make([]string, 0, len(errs))
+		for _, err := range errs {
+			warnings = append(warnings, err.Error())
+		}
+		return admission.Allowed("").WithWarnings(warnings...)
+	}
+	return admission.Denied(errs.ToAggregate().Error())
+}
+
+// changedAnnotations returns the annotations that are added or changed from
+// the old ones. Annotations a workload already had are not validated again on
+// update, so that a workload admitted before a rule was added, or while the
+// validator was in warn-only mode, can still be updated.
+func changedAnnotations(old, annots map[string]string) map[string]string {
+	changed := make(map[string]string, len(annots))
+	for key, value := range annots {
+		if prev, ok := old[key]; !ok || prev != value {
+			changed[key] = value
+		}
+	}
+	return changed
+}
+
+// onlyRemovesFinalizers reports whether the update only removes finalizers
+// from the object, which must never be blocked so it can be deleted.
+func onlyRemovesFinalizers(oldRaw, newRaw []byte) bool {
+	var old, obj unstructured.Unstructured
+	if err := old.UnmarshalJSON(oldRaw); err != nil {
+		return false
+	}
+	if err := obj.UnmarshalJSON(newRaw); err != nil {
+		return false
+	}
+	oldFinalizers, finalizers := old.GetFinalizers(), obj.GetFinalizers()
+	if len(finalizers) >= len(oldFinalizers) {
+		return false
+	}
+	for _, f := range finalizers {
+		if !slices.Contains(oldFinalizers, f) {
+			return false
+		}
+	}
+	for _, u := range []*unstructured.Unstructured{&old, &obj} {
+		u.SetFinalizers(nil)
+		u.SetResourceVersion("")
+		u.SetManagedFields(nil)
+	}
+	return equality.Semantic.DeepEqual(old.Object, obj.Object)
+}
+
+// keysOrDefault returns the keys, or the annotations under annotations.Prefix if
+// they are not set.
+func keysOrDefault(keys annotations.Keys) annotations.Keys {
+	if keys.Prefix == "" {
+		return annotations.DefaultKeys
+	}
+	return keys
+}
@@ -0,0 +1,238 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/Sindvero/vpa-creation-operator/internal/annotations"
+	"github.com/Sindvero/vpa-creation-operator/internal/webhooks"
+)
+
+func workloadRequest(t *testing.T, annotations map[string]string) admission.Request {
+	dep := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+	}
+	raw, err := json.Marshal(dep)
+	require.NoError(t, err)
+
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Namespace: "default",
+		Name:      "web",
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestWorkloadValidator_AllowsValidAnnotations(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/vpa-enabled":  "true",
+		"k8s.autoscaling.vpacreation/update-mode":  "Auto",
+		"k8s.autoscaling.vpacreation/drift-ignore": "updatePolicy, recommenders",
+		"unrelated.example.com/annotation":         "anything",
+	}))
+
+	assert.True(t, res.Allowed)
+	assert.Empty(t, res.Warnings)
+}
+
+func TestWorkloadValidator_RejectsMalformedAnnotations(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/vpa-enabled":  "True",
+		"k8s.autoscaling.vpacreation/update-mode":  "auto",
+		"k8s.autoscaling.vpacreation/vpa-enable":   "true",
+		"k8s.autoscaling.vpacreation/drift-ignore": "updatePolicy,targetRef",
+	}))
+
+	assert.False(t, res.Allowed)
+	msg := res.Result.Message
+	assert.Contains(t, msg, `metadata.annotations[k8s.autoscaling.vpacreation/vpa-enabled]: Unsupported value: "True"`)
+	assert.Contains(t, msg, `metadata.annotations[k8s.autoscaling.vpacreation/update-mode]: Unsupported value: "auto"`)
+	assert.Contains(t, msg, `metadata.annotations[k8s.autoscaling.vpacreation/vpa-enable]: Invalid value: "true": unknown annotation`)
+	assert.Contains(t, msg, `metadata.annotations[k8s.autoscaling.vpacreation/drift-ignore]: Unsupported value: "targetRef"`)
+}
+
+func TestWorkloadValidator_WarnOnly(t *testing.T) {
+	v := &webhooks.WorkloadValidator{WarnOnly: true}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/update-mode": "auto",
+	}))
+
+	assert.True(t, res.Allowed)
+	require.Len(t, res.Warnings, 1)
+	assert.Contains(t, res.Warnings[0], `Unsupported value: "auto"`)
+}
+
+func TestWorkloadValidator_ValidatesAnnotationsUnderPrefix(t *testing.T) {
+	v := &webhooks.WorkloadValidator{Keys: annotations.KeysFor("autoscaling.example.com/")}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"autoscaling.example.com/update-mode":     "auto",
+		"k8s.autoscaling.vpacreation/vpa-enabled": "True",
+	}))
+
+	assert.False(t, res.Allowed)
+	assert.Contains(t, res.Result.Message, "metadata.annotations[autoscaling.example.com/update-mode]")
+	assert.NotContains(t, res.Result.Message, "k8s.autoscaling.vpacreation/vpa-enabled")
+}
+
+func TestWorkloadValidator_AllowsValidConfig(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/config": `
+apiVersion: vpacreation.com/v1alpha1
+kind: VPAConfig
+updateMode: Auto
+profile: frugal
+containers:
+  - name: app
+    minAllowed: {cpu: 100m, memory: 128Mi}
+    maxAllowed: {cpu: "2", memory: 2Gi}
+    controlledResources: [cpu, memory]
+    controlledValues: RequestsOnly
+  - name: "*"
+    mode: "Off"
+`,
+	}))
+
+	assert.True(t, res.Allowed, res.Result)
+}
+
+func TestWorkloadValidator_RejectsInvalidConfig(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/config": `{
+			"apiVersion": "vpacreation.com/v1alpha1", "kind": "VPAConfig", "updateMode": "auto",
+			"containers": [
+				{"name": "app", "minAllowed": {"cpu": "1"}, "maxAllowed": {"cpu": "500m", "gpu": "1"}},
+				{"name": "app", "mode": "On", "controlledValues": "Limits", "controlledResources": ["memory", "memory"]}
+			]
+		}`,
+	}))
+
+	assert.False(t, res.Allowed)
+	msg := res.Result.Message
+	path := "metadata.annotations[k8s.autoscaling.vpacreation/config]"
+	assert.Contains(t, msg, path+`.updateMode: Unsupported value: "auto"`)
+	assert.Contains(t, msg, path+`.containers[0].maxAllowed[gpu]: Unsupported value: "gpu"`)
+	assert.Contains(t, msg, path+`.containers[0].maxAllowed[cpu]: Invalid value: "500m": must not be less than minAllowed 1`)
+	assert.Contains(t, msg, path+`.containers[1].name: Duplicate value: "app"`)
+	assert.Contains(t, msg, path+`.containers[1].mode: Unsupported value: "On"`)
+	assert.Contains(t, msg, path+`.containers[1].controlledResources[1]: Duplicate value: "memory"`)
+	assert.Contains(t, msg, path+`.containers[1].controlledValues: Unsupported value: "Limits"`)
+}
+
+func TestWorkloadValidator_ReportsConfigDecodeErrorsAtField(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/config": "apiVersion: vpacreation.com/v1alpha1\nkind: VPAConfig\nupdateMode: [Auto]\n" +
+			"containers:\n  - name: app\n    minAllowed: {memory: 12XYZ}\n  - name: proxy\n    controlledResources: cpu\n",
+	}))
+
+	assert.False(t, res.Allowed)
+	msg := res.Result.Message
+	path := "metadata.annotations[k8s.autoscaling.vpacreation/config]"
+	assert.Contains(t, msg, path+`.updateMode: Invalid value: ["Auto"]: json: cannot unmarshal array into Go value of type string`)
+	assert.Contains(t, msg, path+`.containers[0].minAllowed[memory]: Invalid value: "12XYZ": quantities must match the regular expression`)
+	assert.Contains(t, msg, path+`.containers[1].controlledResources: Invalid value: "cpu": json: cannot unmarshal string`)
+}
+
+func TestWorkloadValidator_RejectsUnknownConfigFields(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+
+	res := v.Handle(context.TODO(), workloadRequest(t, map[string]string{
+		"k8s.autoscaling.vpacreation/config": "apiVersion: vpacreation.com/v1alpha1\nkind: VPAConfig\ncontainers:\n  - name: app\n    minAllowd: {cpu: 100m}\n",
+	}))
+
+	assert.False(t, res.Allowed)
+	assert.Contains(t, res.Result.Message, "metadata.annotations[k8s.autoscaling.vpacreation/config].containers[0].minAllowd: Forbidden: unknown field")
+}
+
+func workloadUpdateRequest(t *testing.T, old, dep *appsv1.Deployment) admission.Request {
+	req := workloadRequest(t, nil)
+	req.Operation = admissionv1.Update
+	for _, o := range []struct {
+		dep *appsv1.Deployment
+		raw *runtime.RawExtension
+	}{{old, &req.OldObject}, {dep, &req.Object}} {
+		o.dep.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+		raw, err := json.Marshal(o.dep)
+		require.NoError(t, err)
+		o.raw.Raw = raw
+	}
+	return req
+}
+
+func TestWorkloadValidator_OnUpdateValidatesChangedAnnotationsOnly(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+	old := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{
+		"k8s.autoscaling.vpacreation/update-mode": "auto",
+	}}}
+
+	// The malformed annotation admitted earlier does not block other changes.
+	dep := old.DeepCopy()
+	dep.Annotations["k8s.autoscaling.vpacreation/vpa-enabled"] = "true"
+	res := v.Handle(context.TODO(), workloadUpdateRequest(t, old, dep))
+	assert.True(t, res.Allowed, res.Result)
+
+	dep = old.DeepCopy()
+	dep.Annotations["k8s.autoscaling.vpacreation/vpa-enabled"] = "True"
+	res = v.Handle(context.TODO(), workloadUpdateRequest(t, old, dep))
+	assert.False(t, res.Allowed)
+	assert.Contains(t, res.Result.Message, "k8s.autoscaling.vpacreation/vpa-enabled")
+	assert.NotContains(t, res.Result.Message, "k8s.autoscaling.vpacreation/update-mode")
+
+	dep = old.DeepCopy()
+	dep.Annotations["k8s.autoscaling.vpacreation/update-mode"] = "initial"
+	res = v.Handle(context.TODO(), workloadUpdateRequest(t, old, dep))
+	assert.False(t, res.Allowed)
+	assert.Contains(t, res.Result.Message, `Unsupported value: "initial"`)
+}
+
+func TestWorkloadValidator_AllowsDeletion(t *testing.T) {
+	v := &webhooks.WorkloadValidator{}
+	old := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name:       "web",
+		Namespace:  "default",
+		Finalizers: []string{"example.com/cleanup", "example.com/backup"},
+	}}
+
+	dep := old.DeepCopy()
+	dep.DeletionTimestamp = ptr.To(metav1.Now())
+	dep.Annotations = map[string]string{"k8s.autoscaling.vpacreation/update-mode": "auto"}
+	res := v.Handle(context.TODO(), workloadUpdateRequest(t, old, dep))
+	assert.True(t, res.Allowed, res.Result)
+
+	// Removing finalizers is allowed even if the annotations are now malformed,
+	// e.g. after the validator was enabled.
+	old.Annotations = map[string]string{"k8s.autoscaling.vpacreation/update-mode": "auto"}
+	dep = old.DeepCopy()
+	dep.Annotations = map[string]string{"k8s.autoscaling.vpacreation/update-mode": "auto"}
+	dep.Finalizers = []string{"example.com/backup"}
+	res = v.Handle(context.TODO(), workloadUpdateRequest(t, old, dep))
+	assert.True(t, res.Allowed, res.Result)
+
+	// Any other change along with the finalizer removal is validated.
+	dep.Annotations["k8s.autoscaling.vpacreation/vpa-enabled"] = "True"
+	res = v.Handle(context.TODO(), workloadUpdateRequest(t, old, dep))
+	assert.False(t, res.Allowed)
+}